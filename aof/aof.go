@@ -0,0 +1,459 @@
+// Package aof implements append-only file persistence: every write command
+// is logged in RESP form and replayed on startup to rebuild the dataset.
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"zencache/resp"
+)
+
+// FsyncPolicy controls how often the file is flushed to stable storage.
+type FsyncPolicy int
+
+const (
+	FsyncEverySec FsyncPolicy = iota // fsync once per second in the background
+	FsyncAlways                      // fsync after every command
+	FsyncNo                          // leave flushing to the operating system
+)
+
+var fsyncNames = []string{
+	FsyncEverySec: "everysec",
+	FsyncAlways:   "always",
+	FsyncNo:       "no",
+}
+
+// String returns the policy's configuration name.
+func (p FsyncPolicy) String() string {
+	if p >= 0 && int(p) < len(fsyncNames) {
+		return fsyncNames[p]
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+}
+
+// ParseFsyncPolicy converts "always", "everysec" or "no" to a FsyncPolicy.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for p, n := range fsyncNames {
+		if n == strings.ToLower(name) {
+			return FsyncPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid appendfsync policy '%s'", name)
+}
+
+// ErrRewriteInProgress is returned when a rewrite is requested while one is
+// already running.
+var ErrRewriteInProgress = errors.New("background append only file rewriting already in progress")
+
+// AOF is an open append-only file.
+type AOF struct {
+	mu        sync.Mutex
+	syncMu    sync.Mutex // held by an fsync, which runs without mu so appends continue
+	path      string
+	file      *os.File
+	policy    FsyncPolicy
+	size      int64
+	baseSize  int64 // size after the last rewrite, or when opened
+	dirty     bool  // written since the last fsync
+	lastErr   error // the last failed write or fsync, until a retry succeeds
+	lastFsync time.Time
+	done      chan struct{}
+
+	rewriteBuf     *bytes.Buffer // commands appended during a rewrite, nil otherwise
+	rewrites       int
+	lastRewriteErr error
+}
+
+// Open opens path for appending, creating it if needed. Under
+// FsyncEverySec a background goroutine syncs the file once per second
+// until Close.
+func Open(path string, policy FsyncPolicy) (*AOF, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	a := &AOF{
+		path:      path,
+		file:      file,
+		policy:    policy,
+		size:      info.Size(),
+		baseSize:  info.Size(),
+		lastFsync: time.Now(),
+		done:      make(chan struct{}),
+	}
+	go a.syncLoop()
+	return a, nil
+}
+
+// Append logs a command. The data reaches the operating system before
+// Append returns but is not synced to disk; under FsyncAlways callers
+// follow their appends with Flush before acknowledging them.
+func (a *AOF) Append(args []string) error {
+	payload := resp.EncodeCommand(args)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriteBuf != nil {
+		a.rewriteBuf.Write(payload)
+	}
+	n, err := a.file.Write(payload)
+	if err != nil {
+		// Cut off a partial command so that later ones stay readable.
+		if n > 0 && a.file.Truncate(a.size) != nil {
+			a.size += int64(n)
+		}
+		a.dirty = true
+		a.lastErr = err
+		return err
+	}
+	a.size += int64(n)
+	a.dirty = true
+	return nil
+}
+
+// Flush syncs the commands appended so far to disk if the policy is
+// FsyncAlways, then returns LastError. Other appends may proceed while it
+// waits, and one fsync covers all of them.
+func (a *AOF) Flush() error {
+	if a.Policy() == FsyncAlways {
+		a.syncFile()
+	}
+	return a.LastError()
+}
+
+// syncFile flushes the file to disk without holding a.mu.
+func (a *AOF) syncFile() error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	a.mu.Lock()
+	file, dirty := a.file, a.dirty
+	a.dirty = false
+	a.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	err := file.Sync()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if file != a.file {
+		// A rewrite swapped in a new file, synced when it was written.
+		return nil
+	}
+	if err != nil {
+		a.dirty = true
+		a.lastErr = err
+		return err
+	}
+	a.lastFsync = time.Now()
+	return nil
+}
+
+// sync flushes the file to disk. Callers must hold a.mu.
+func (a *AOF) sync() error {
+	if !a.dirty {
+		return nil
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.dirty = false
+	a.lastFsync = time.Now()
+	return nil
+}
+
+func (a *AOF) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			everySec, failed := a.policy == FsyncEverySec, a.lastErr != nil
+			a.mu.Unlock()
+			switch {
+			case failed:
+				a.retry()
+			case everySec:
+				a.syncFile()
+			}
+		}
+	}
+}
+
+// retry clears the last error once the file can be synced again.
+func (a *AOF) retry() {
+	a.mu.Lock()
+	failed := a.lastErr
+	a.dirty = true
+	a.mu.Unlock()
+
+	if a.syncFile() != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastErr == failed {
+		a.lastErr = nil
+	}
+}
+
+// SetPolicy changes the fsync policy.
+func (a *AOF) SetPolicy(policy FsyncPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = policy
+}
+
+// Policy returns the fsync policy.
+func (a *AOF) Policy() FsyncPolicy {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.policy
+}
+
+// Size returns the current file size in bytes.
+func (a *AOF) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// BaseSize returns the file size after the last rewrite, or when the file
+// was opened if it has never been rewritten. Growth relative to it drives
+// automatic rewrites.
+func (a *AOF) BaseSize() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.baseSize
+}
+
+// LastError returns the error from the last failed write or fsync, or nil
+// if there was none or a later retry succeeded. The file is retried once
+// per second while it is set.
+func (a *AOF) LastError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastErr
+}
+
+// Rewrite replaces the file with the shortest command sequence that rebuilds
+// the current dataset. dump writes that sequence through emit. Commands
+// appended while dump runs are buffered and copied to the end of the new
+// file, which then atomically replaces the old one. Appends only wait for
+// that final copy, not for dump.
+//
+// dump may observe some of the buffered commands' effects, so the buffered
+// commands must be idempotent, as propagated commands are.
+func (a *AOF) Rewrite(dump func(emit func(args []string) error) error) error {
+	if err := a.beginRewrite(); err != nil {
+		return err
+	}
+	return a.rewrite(dump)
+}
+
+// BackgroundRewrite starts Rewrite in a new goroutine. The outcome is
+// reported by Rewriting and LastRewriteError.
+func (a *AOF) BackgroundRewrite(dump func(emit func(args []string) error) error) error {
+	if err := a.beginRewrite(); err != nil {
+		return err
+	}
+	go a.rewrite(dump)
+	return nil
+}
+
+func (a *AOF) beginRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriteBuf != nil {
+		return ErrRewriteInProgress
+	}
+	a.rewriteBuf = new(bytes.Buffer)
+	return nil
+}
+
+func (a *AOF) rewrite(dump func(emit func(args []string) error) error) error {
+	err := a.writeRewrite(dump)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriteBuf = nil
+	a.rewrites++
+	a.lastRewriteErr = err
+	return err
+}
+
+// writeRewrite writes the dataset to a temporary file in the same
+// directory and swaps it in.
+func (a *AOF) writeRewrite(dump func(emit func(args []string) error) error) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	// CreateTemp restricts the file to its owner; match Open instead.
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = dump(func(args []string) error {
+		_, err := w.Write(resp.EncodeCommand(args))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// Sync the bulk of the data before blocking appends.
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := tmp.Write(a.rewriteBuf.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+	swapped = true
+
+	a.file.Close()
+	a.file = tmp
+	a.size = info.Size()
+	a.baseSize = a.size
+	a.dirty = false
+	a.lastFsync = time.Now()
+	return nil
+}
+
+// Rewriting reports whether a rewrite is running.
+func (a *AOF) Rewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriteBuf != nil
+}
+
+// Rewrites returns the number of rewrites attempted since the file was
+// opened.
+func (a *AOF) Rewrites() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewrites
+}
+
+// LastRewriteError returns the error from the most recent rewrite, or nil
+// if it succeeded or none has run.
+func (a *AOF) LastRewriteError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastRewriteErr
+}
+
+// Path returns the file path.
+func (a *AOF) Path() string {
+	return a.path
+}
+
+// Close syncs and closes the file.
+func (a *AOF) Close() error {
+	close(a.done)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.dirty = true
+	err := a.sync()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LoadResult describes a replayed file.
+type LoadResult struct {
+	Commands  int   // commands applied
+	Truncated int64 // bytes of an incomplete trailing command that were cut off
+}
+
+// Load replays every command in path through apply. A command cut short at
+// the end of the file, as left by a crash mid-write, is discarded and the
+// file truncated to the last complete command. Corruption anywhere else is
+// returned as an error so the server refuses to start on a damaged file.
+// A missing file loads nothing.
+func Load(path string, apply func(args []string)) (LoadResult, error) {
+	var res LoadResult
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	defer file.Close()
+
+	reader := resp.NewReader(file)
+	for {
+		valid := reader.Count()
+		args, _, err := reader.ReadCommand()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			info, serr := file.Stat()
+			if serr != nil {
+				return res, serr
+			}
+			res.Truncated = info.Size() - valid
+			return res, os.Truncate(path, valid)
+		}
+		if err != nil {
+			return res, fmt.Errorf("bad file format reading the append only file at offset %d: %w", valid, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		apply(args)
+		res.Commands++
+	}
+}
@@ -0,0 +1,253 @@
+package aof
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	a, err := Open(path, FsyncAlways)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	commands := [][]string{
+		{"SET", "key1", "hello world"},
+		{"SET", "key2", "line\r\nbreak"},
+		{"DEL", "key1"},
+	}
+	for _, cmd := range commands {
+		if err := a.Append(cmd); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if a.Size() != info.Size() {
+		t.Errorf("Expected size %d, got %d", info.Size(), a.Size())
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	var loaded [][]string
+	res, err := Load(path, func(args []string) { loaded = append(loaded, args) })
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if res.Commands != len(commands) || res.Truncated != 0 {
+		t.Errorf("Unexpected load result %+v", res)
+	}
+	if !reflect.DeepEqual(loaded, commands) {
+		t.Errorf("Expected %q, got %q", commands, loaded)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	res, err := Load(filepath.Join(t.TempDir(), "missing.aof"), func([]string) {
+		t.Error("Expected no commands")
+	})
+	if err != nil || res.Commands != 0 {
+		t.Errorf("Expected empty load, got %+v, %v", res, err)
+	}
+}
+
+func TestLoadTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	partial := "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$5\r\nhel"
+	if err := os.WriteFile(path, []byte(complete+partial), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Load(path, func([]string) {})
+	if err != nil {
+		t.Fatalf("Expected truncated tail to be recovered, got %v", err)
+	}
+	if res.Commands != 1 || res.Truncated != int64(len(partial)) {
+		t.Errorf("Unexpected load result %+v", res)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != complete {
+		t.Errorf("Expected file truncated to %q, got %q", complete, data)
+	}
+
+	// Appending after recovery yields a valid file.
+	a, err := Open(path, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Append([]string{"SET", "b", "2"})
+	a.Close()
+	res, err = Load(path, func([]string) {})
+	if err != nil || res.Commands != 2 {
+		t.Errorf("Expected 2 commands after recovery, got %+v, %v", res, err)
+	}
+}
+
+func TestLoadCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	data := "*2\r\n$3\r\nDEL\r\n$1\r\na\r\n*2\r\n$3\r\nDEL\r\n$x\r\nb\r\n*1\r\n$4\r\nPING\r\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Load(path, func([]string) {})
+	if err == nil {
+		t.Fatal("Expected an error for a corrupt file")
+	}
+	if !strings.Contains(err.Error(), "offset 20") {
+		t.Errorf("Expected the error to report the offset, got %v", err)
+	}
+	if res.Commands != 1 {
+		t.Errorf("Expected 1 command before the corruption, got %d", res.Commands)
+	}
+	if got, _ := os.ReadFile(path); string(got) != data {
+		t.Error("Expected a corrupt file to be left untouched")
+	}
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, p := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		parsed, err := ParseFsyncPolicy(strings.ToUpper(p.String()))
+		if err != nil || parsed != p {
+			t.Errorf("Expected %s to round trip, got %v, %v", p, parsed, err)
+		}
+	}
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	a, err := Open(path, FsyncNo)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer a.Close()
+	for i := 0; i < 100; i++ {
+		a.Append([]string{"SET", "counter", "value"})
+	}
+	before := a.Size()
+
+	err = a.Rewrite(func(emit func([]string) error) error {
+		// Commands appended during the dump are kept after it.
+		if err := a.Append([]string{"SET", "late", "1"}); err != nil {
+			return err
+		}
+		return emit([]string{"SET", "counter", "value"})
+	})
+	if err != nil {
+		t.Fatalf("Failed to rewrite: %v", err)
+	}
+	a.Append([]string{"DEL", "counter"})
+
+	if a.Size() >= before {
+		t.Errorf("Expected rewrite to shrink the file from %d bytes, got %d", before, a.Size())
+	}
+	if a.Rewriting() || a.Rewrites() != 1 || a.LastRewriteError() != nil {
+		t.Errorf("Unexpected rewrite state: rewriting=%v rewrites=%d err=%v", a.Rewriting(), a.Rewrites(), a.LastRewriteError())
+	}
+
+	var loaded [][]string
+	if _, err := Load(path, func(args []string) { loaded = append(loaded, args) }); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	expected := [][]string{{"SET", "counter", "value"}, {"SET", "late", "1"}, {"DEL", "counter"}}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("Expected %q, got %q", expected, loaded)
+	}
+	if info, _ := os.Stat(path); info.Size() != a.Size() || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected a %d byte 0644 file, got %d bytes %v", a.Size(), info.Size(), info.Mode().Perm())
+	}
+}
+
+func TestRewriteFailureKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	a, err := Open(path, FsyncNo)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer a.Close()
+	a.Append([]string{"SET", "a", "1"})
+
+	dumpErr := errors.New("dump failed")
+	release := make(chan struct{})
+	err = a.BackgroundRewrite(func(emit func([]string) error) error {
+		<-release
+		return dumpErr
+	})
+	if err != nil {
+		t.Fatalf("Failed to start rewrite: %v", err)
+	}
+	if err := a.BackgroundRewrite(nil); err != ErrRewriteInProgress {
+		t.Errorf("Expected ErrRewriteInProgress, got %v", err)
+	}
+	close(release)
+	for a.Rewriting() {
+		time.Sleep(time.Millisecond)
+	}
+	if a.LastRewriteError() != dumpErr {
+		t.Errorf("Expected the dump error, got %v", a.LastRewriteError())
+	}
+
+	a.Append([]string{"SET", "b", "2"})
+	res, err := Load(path, func([]string) {})
+	if err != nil || res.Commands != 2 {
+		t.Errorf("Expected the original file to keep logging, got %+v, %v", res, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the temporary file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestWriteErrorUntilRetrySucceeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	a, err := Open(path, FsyncAlways)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer a.Close()
+	a.Append([]string{"SET", "a", "1"})
+
+	// Appends fail once the descriptor is unusable, and the error sticks.
+	good := a.file
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer readOnly.Close()
+	a.file = readOnly
+	if err := a.Append([]string{"SET", "b", "2"}); err == nil {
+		t.Fatal("Expected the append to fail")
+	}
+	a.file = good
+	if err := a.Flush(); err == nil {
+		t.Error("Expected Flush to report the failed append")
+	}
+	if a.LastError() == nil {
+		t.Error("Expected LastError to be set")
+	}
+
+	a.retry()
+	if err := a.Flush(); err != nil {
+		t.Errorf("Expected a successful retry to clear the error, got %v", err)
+	}
+	res, err := Load(path, func([]string) {})
+	if err != nil || res.Commands != 1 {
+		t.Errorf("Expected only the first command in the file, got %+v, %v", res, err)
+	}
+}
@@ -2,21 +2,81 @@ package main_test
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"zencache/aof"
+	"zencache/lru"
+	"zencache/rdb"
+	"zencache/resp"
 	"zencache/server"
 )
 
+// startServer starts a server with cfg and connects to it, returning a
+// function that sends a command and reads the reply. The server is shut
+// down when the test ends. Unless cfg names a data directory, the server
+// gets its own temporary one.
+func startServer(t *testing.T, cfg server.Config) func(args ...string) resp.Value {
+	t.Helper()
+	if cfg.Dir == "." {
+		cfg.Dir = t.TempDir()
+	}
+	srv := server.NewServerWithConfig(cfg)
+	go func() {
+		srv.Start()
+	}()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	reader := resp.NewReader(conn)
+
+	return func(args ...string) resp.Value {
+		if _, err := conn.Write(resp.EncodeCommand(args)); err != nil {
+			t.Fatalf("Failed to write command: %v", err)
+		}
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return v
+	}
+}
+
+// infoField returns the value of field in the given INFO section, or ""
+// if it is missing.
+func infoField(send func(args ...string) resp.Value, section, field string) string {
+	for _, line := range strings.Split(send("INFO", section).Str, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
 func TestCoreOperations(t *testing.T) {
 	// Start server in a goroutine
 	port := 6380
-	srv := server.NewServer(port)
+	cfg := server.DefaultConfig(port)
+	cfg.Dir = t.TempDir()
+	srv := server.NewServerWithConfig(cfg)
 	go func() {
 		srv.Start()
 	}()
+	t.Cleanup(func() { srv.Shutdown() })
 
 	// Give it a moment to start
 	time.Sleep(100 * time.Millisecond)
@@ -72,4 +132,1136 @@ func TestCoreOperations(t *testing.T) {
 	if resp := sendCommand("GET mykey"); resp != "(nil)" {
 		t.Errorf("Expected (nil), got %s", resp)
 	}
+
+	// PUBLISH takes the rest of the line as its message
+	if resp := sendCommand("PUBLISH notifications Hello subscribers!"); resp != "(integer) 0" {
+		t.Errorf("Expected (integer) 0, got %s", resp)
+	}
+}
+
+func TestRESPProtocol(t *testing.T) {
+	sendCommand := startServer(t, server.DefaultConfig(6381))
+
+	// Values with spaces, newlines and binary bytes must survive intact
+	value := "hello world\r\n\x00\xff"
+	if v := sendCommand("SET", "bin", value); v.Type != resp.SimpleString || v.Str != "OK" {
+		t.Errorf("Expected +OK, got %+v", v)
+	}
+	if v := sendCommand("GET", "bin"); v.Type != resp.BulkString || v.Str != value {
+		t.Errorf("Expected %q, got %+v", value, v)
+	}
+
+	if v := sendCommand("GET", "missing"); v.Type != resp.BulkString || !v.Null {
+		t.Errorf("Expected null bulk, got %+v", v)
+	}
+
+	if v := sendCommand("DEL", "bin", "missing"); v.Type != resp.Integer || v.Int != 1 {
+		t.Errorf("Expected :1, got %+v", v)
+	}
+
+	if v := sendCommand("NOPE"); v.Type != resp.Error {
+		t.Errorf("Expected error, got %+v", v)
+	}
+}
+
+func TestRESP3PubSub(t *testing.T) {
+	port := 6382
+	cfg := server.DefaultConfig(port)
+	cfg.Dir = t.TempDir()
+	srv := server.NewServerWithConfig(cfg)
+	go func() {
+		srv.Start()
+	}()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	time.Sleep(100 * time.Millisecond)
+
+	sub, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	defer sub.Close()
+	pub, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	defer pub.Close()
+
+	subReader := resp.NewReader(sub)
+	pubReader := resp.NewReader(pub)
+
+	send := func(conn net.Conn, reader *resp.Reader, args ...string) resp.Value {
+		if _, err := conn.Write(resp.EncodeCommand(args)); err != nil {
+			t.Fatalf("Failed to write command: %v", err)
+		}
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return v
+	}
+
+	if v := send(sub, subReader, "HELLO", "3"); v.Type != resp.Map {
+		t.Fatalf("Expected map reply to HELLO 3, got %+v", v)
+	}
+	if v := send(sub, subReader, "SUBSCRIBE", "news"); v.Type != resp.Push || v.Array[0].Str != "subscribe" {
+		t.Errorf("Expected subscribe push, got %+v", v)
+	}
+
+	// Normal commands keep working on a subscribed RESP3 connection
+	send(pub, pubReader, "SET", "k", "v")
+	if v := send(sub, subReader, "GET", "k"); v.Type != resp.BulkString || v.Str != "v" {
+		t.Errorf("Expected v, got %+v", v)
+	}
+
+	if v := send(pub, pubReader, "PUBLISH", "news", "hello"); v.Int != 1 {
+		t.Errorf("Expected 1 receiver, got %+v", v)
+	}
+	v, err := subReader.ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if v.Type != resp.Push || len(v.Array) != 3 || v.Array[0].Str != "message" || v.Array[2].Str != "hello" {
+		t.Errorf("Expected message push, got %+v", v)
+	}
+
+	if v := send(pub, pubReader, "HELLO", "4"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "NOPROTO") {
+		t.Errorf("Expected NOPROTO error, got %+v", v)
+	}
+}
+
+func TestKeyExpiration(t *testing.T) {
+	sendCommand := startServer(t, server.DefaultConfig(6383))
+
+	if v := sendCommand("SET", "session", "abc", "PX", "100"); v.Str != "OK" {
+		t.Errorf("Expected OK, got %+v", v)
+	}
+	if v := sendCommand("PTTL", "session"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected PTTL in (0, 100], got %+v", v)
+	}
+	if v := sendCommand("SET", "session", "def", "NX"); !v.Null {
+		t.Errorf("Expected NX on existing key to return nil, got %+v", v)
+	}
+	if v := sendCommand("SET", "session", "ghi", "XX", "GET", "KEEPTTL"); v.Str != "abc" {
+		t.Errorf("Expected GET to return old value, got %+v", v)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if v := sendCommand("GET", "session"); !v.Null {
+		t.Errorf("Expected expired key to be missing, got %+v", v)
+	}
+	if v := sendCommand("TTL", "session"); v.Int != -2 {
+		t.Errorf("Expected TTL -2, got %+v", v)
+	}
+
+	sendCommand("SET", "k", "v")
+	if v := sendCommand("TTL", "k"); v.Int != -1 {
+		t.Errorf("Expected TTL -1, got %+v", v)
+	}
+	if v := sendCommand("EXPIRE", "k", "100"); v.Int != 1 {
+		t.Errorf("Expected EXPIRE to return 1, got %+v", v)
+	}
+	if v := sendCommand("TTL", "k"); v.Int != 100 {
+		t.Errorf("Expected TTL 100, got %+v", v)
+	}
+	if v := sendCommand("PERSIST", "k"); v.Int != 1 {
+		t.Errorf("Expected PERSIST to return 1, got %+v", v)
+	}
+	if v := sendCommand("SET", "k", "v", "EX", "0"); v.Type != resp.Error {
+		t.Errorf("Expected invalid expire error, got %+v", v)
+	}
+}
+
+func TestConfigEvictionPolicy(t *testing.T) {
+	sendCommand := startServer(t, server.DefaultConfig(6384))
+
+	if v := sendCommand("CONFIG", "SET", "maxmemory-policy", "noeviction", "capacity", "2"); v.Str != "OK" {
+		t.Fatalf("Expected OK, got %+v", v)
+	}
+	v := sendCommand("CONFIG", "GET", "maxmemory*")
+	if len(v.Array) != 4 || v.Array[3].Str != "noeviction" {
+		t.Errorf("Expected maxmemory and maxmemory-policy, got %+v", v)
+	}
+
+	sendCommand("SET", "a", "1")
+	sendCommand("SET", "b", "2")
+	sendCommand("SET", "c", "3")
+	if v := sendCommand("SET", "d", "4"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "OOM") {
+		t.Errorf("Expected OOM error, got %+v", v)
+	}
+	if v := sendCommand("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected reads to keep working, got %+v", v)
+	}
+
+	if v := sendCommand("CONFIG", "SET", "maxmemory-policy", "bogus"); v.Type != resp.Error {
+		t.Errorf("Expected error for unknown policy, got %+v", v)
+	}
+	if v := sendCommand("CONFIG", "SET", "port", "1"); v.Type != resp.Error {
+		t.Errorf("Expected error for immutable setting, got %+v", v)
+	}
+	if v := sendCommand("CONFIG", "SET", "maxmemory", "99999999999gb"); v.Type != resp.Error {
+		t.Errorf("Expected error for a limit that overflows, got %+v", v)
+	}
+}
+
+func TestAppendOnlyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+
+	start := func(port int) func(args ...string) resp.Value {
+		cfg := server.DefaultConfig(port)
+		cfg.AppendOnly = true
+		cfg.AppendFilename = path
+		cfg.AppendFsync = aof.FsyncAlways
+		return startServer(t, cfg)
+	}
+
+	sendCommand := start(6385)
+	sendCommand("SET", "kept", "hello world")
+	sendCommand("SET", "gone", "x")
+	sendCommand("DEL", "gone")
+	sendCommand("SET", "session", "abc")
+	sendCommand("EXPIRE", "session", "100")
+	sendCommand("SET", "expired", "x", "PX", "1")
+	sendCommand("GET", "missing")
+
+	// A second server replaying the same file sees the same dataset.
+	time.Sleep(10 * time.Millisecond)
+	sendCommand = start(6386)
+	if v := sendCommand("GET", "kept"); v.Str != "hello world" {
+		t.Errorf("Expected kept value, got %+v", v)
+	}
+	if v := sendCommand("GET", "gone"); !v.Null {
+		t.Errorf("Expected deleted key to stay deleted, got %+v", v)
+	}
+	if v := sendCommand("TTL", "session"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected TTL to be restored, got %+v", v)
+	}
+	if v := sendCommand("GET", "expired"); !v.Null {
+		t.Errorf("Expected expired key to stay expired, got %+v", v)
+	}
+	v := sendCommand("INFO", "persistence")
+	if !strings.Contains(v.Str, "aof_enabled:1") || !strings.Contains(v.Str, "aof_last_write_status:ok") {
+		t.Errorf("Expected AOF status in INFO, got %q", v.Str)
+	}
+
+	// Compact the file and check a third server still sees the same data.
+	if v := sendCommand("BGREWRITEAOF"); v.Type != resp.SimpleString {
+		t.Fatalf("Expected rewrite to start, got %+v", v)
+	}
+	for i := 0; i < 100 && strings.Contains(sendCommand("INFO", "persistence").Str, "aof_rewrite_in_progress:1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	v = sendCommand("INFO", "persistence")
+	if !strings.Contains(v.Str, "aof_rewrites:1") || !strings.Contains(v.Str, "aof_last_bgrewrite_status:ok") {
+		t.Errorf("Expected a successful rewrite in INFO, got %q", v.Str)
+	}
+	sendCommand("SET", "after", "rewrite")
+
+	sendCommand = start(6387)
+	if offset := infoField(sendCommand, "replication", "master_repl_offset"); offset != "0" {
+		t.Errorf("Expected the replayed writes not to be propagated, got offset %s", offset)
+	}
+	if v := sendCommand("GET", "kept"); v.Str != "hello world" {
+		t.Errorf("Expected kept value after rewrite, got %+v", v)
+	}
+	if v := sendCommand("GET", "after"); v.Str != "rewrite" {
+		t.Errorf("Expected writes after the rewrite to be logged, got %+v", v)
+	}
+	if v := sendCommand("TTL", "session"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected TTL to survive the rewrite, got %+v", v)
+	}
+
+	// Logged writes are replayed even if the limit no longer allows them.
+	cfg := server.DefaultConfig(6414)
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.MaxMemoryPolicy = lru.NoEviction
+	cfg.Capacity = 1
+	sendCommand = startServer(t, cfg)
+	for _, key := range []string{"kept", "after"} {
+		if v := sendCommand("GET", key); v.Type != resp.BulkString || v.Null {
+			t.Errorf("Expected %s to be replayed over the limit, got %+v", key, v)
+		}
+	}
+}
+
+func TestBackgroundSave(t *testing.T) {
+	cfg := server.DefaultConfig(6388)
+	cfg.Dir = t.TempDir()
+	sendCommand := startServer(t, cfg)
+
+	for i := 0; i < 100; i++ {
+		sendCommand("SET", fmt.Sprintf("key:%d", i), "value")
+	}
+	before := sendCommand("LASTSAVE").Int
+
+	if v := sendCommand("BGSAVE"); v.Str != "Background saving started" {
+		t.Fatalf("Expected BGSAVE to start, got %+v", v)
+	}
+	for i := 0; i < 100 && strings.Contains(sendCommand("INFO", "persistence").Str, "rdb_bgsave_in_progress:1"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	v := sendCommand("INFO", "persistence")
+	if !strings.Contains(v.Str, "rdb_last_bgsave_status:ok") || !strings.Contains(v.Str, "rdb_saves:1") {
+		t.Errorf("Expected a successful save in INFO, got %q", v.Str)
+	}
+	if v := sendCommand("LASTSAVE"); v.Int < before {
+		t.Errorf("Expected LASTSAVE to advance from %d, got %d", before, v.Int)
+	}
+
+	data, err := rdb.NewRDB(filepath.Join(cfg.Dir, "zencache.rdb")).Load()
+	if err != nil || len(data) != 100 {
+		t.Errorf("Expected 100 saved keys, got %d, %v", len(data), err)
+	}
+}
+
+func TestSaveRulesAndShutdown(t *testing.T) {
+	port := 6389
+	cfg := server.DefaultConfig(port)
+	cfg.Dir = t.TempDir()
+	cfg.Save = []server.SaveRule{{Seconds: 1, Changes: 2}}
+	srv := server.NewServerWithConfig(cfg)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Start()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	reader := resp.NewReader(conn)
+
+	sendCommand := func(args ...string) resp.Value {
+		if _, err := conn.Write(resp.EncodeCommand(args)); err != nil {
+			t.Fatalf("Failed to write command: %v", err)
+		}
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return v
+	}
+
+	if v := sendCommand("CONFIG", "GET", "save"); len(v.Array) != 2 || v.Array[1].Str != "1 2" {
+		t.Errorf("Expected save rules \"1 2\", got %+v", v)
+	}
+	if v := sendCommand("CONFIG", "SET", "save", "1"); v.Type != resp.Error {
+		t.Errorf("Expected error for an odd number of save parameters, got %+v", v)
+	}
+
+	sendCommand("SET", "a", "1")
+	if v := sendCommand("INFO", "persistence"); !strings.Contains(v.Str, "rdb_changes_since_last_save:1") {
+		t.Errorf("Expected one change, got %q", v.Str)
+	}
+	// One change is below the rule's threshold.
+	time.Sleep(1200 * time.Millisecond)
+	if v := sendCommand("INFO", "persistence"); !strings.Contains(v.Str, "rdb_saves:0") {
+		t.Errorf("Expected no automatic save yet, got %q", v.Str)
+	}
+
+	sendCommand("SET", "b", "2")
+	time.Sleep(300 * time.Millisecond)
+	v := sendCommand("INFO", "persistence")
+	if !strings.Contains(v.Str, "rdb_saves:1") || !strings.Contains(v.Str, "rdb_changes_since_last_save:0") {
+		t.Errorf("Expected an automatic save, got %q", v.Str)
+	}
+
+	// SHUTDOWN writes a final snapshot, closes the connection and stops
+	// the server.
+	sendCommand("SET", "c", "3")
+	conn.Write(resp.EncodeCommand([]string{"SHUTDOWN"}))
+	if _, err := reader.ReadValue(); err == nil {
+		t.Error("Expected the connection to close without a reply")
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected Start to return nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Start to return after SHUTDOWN")
+	}
+	data, err := rdb.NewRDB(filepath.Join(cfg.Dir, "zencache.rdb")).Load()
+	if err != nil || data["c"] != "3" {
+		t.Errorf("Expected the final snapshot to include c, got %v, %v", data, err)
+	}
+}
+
+func TestCorruptSnapshotRefusesToStart(t *testing.T) {
+	cfg := server.DefaultConfig(6390)
+	cfg.Dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.Dir, "zencache.rdb"), []byte("ZENCACHE0003 not a snapshot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := server.NewServerWithConfig(cfg).Start()
+	if !errors.Is(err, rdb.ErrCorrupt) {
+		t.Errorf("Expected Start to fail with ErrCorrupt, got %v", err)
+	}
+}
+
+func TestSnapshotKeepsMetadata(t *testing.T) {
+	dir := t.TempDir()
+
+	start := func(port int) func(args ...string) resp.Value {
+		cfg := server.DefaultConfig(port)
+		cfg.Dir = dir
+		cfg.Capacity = 3
+		cfg.Shards = 1
+		return startServer(t, cfg)
+	}
+
+	sendCommand := start(6391)
+	sendCommand("SET", "a", "1")
+	time.Sleep(2 * time.Millisecond)
+	sendCommand("SET", "b", "2", "EX", "100")
+	time.Sleep(2 * time.Millisecond)
+	sendCommand("SET", "c", "3", "PX", "50")
+	time.Sleep(2 * time.Millisecond)
+	sendCommand("GET", "a") // b is now the least recently used
+	if v := sendCommand("SAVE"); v.Str != "OK" {
+		t.Fatalf("Expected SAVE to succeed, got %+v", v)
+	}
+	time.Sleep(100 * time.Millisecond) // c expires while saved
+
+	sendCommand = start(6392)
+	if v := sendCommand("TTL", "b"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected b to keep its TTL, got %+v", v)
+	}
+	if v := sendCommand("GET", "c"); !v.Null {
+		t.Errorf("Expected c to be dropped on load, got %+v", v)
+	}
+	if v := sendCommand("INFO", "keyspace"); !strings.Contains(v.Str, "keys=2,expires=1") {
+		t.Errorf("Expected 2 keys with 1 expiry, got %q", v.Str)
+	}
+
+	// Filling the cache evicts in the order recorded before the restart.
+	sendCommand("SET", "d", "4")
+	sendCommand("SET", "e", "5")
+	if v := sendCommand("GET", "b"); !v.Null {
+		t.Errorf("Expected b, the least recently used key, to be evicted, got %+v", v)
+	}
+	if v := sendCommand("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to survive, got %+v", v)
+	}
+}
+
+func TestRedisFormatAndDebugReload(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "zencache.rdb")
+
+	start := func(cfg server.Config) func(args ...string) resp.Value {
+		cfg.Save = nil
+		return startServer(t, cfg)
+	}
+
+	cfg := server.DefaultConfig(6393)
+	cfg.Dir = dir
+	cfg.RDBFormat = rdb.FormatRedis
+	sendCommand := start(cfg)
+
+	sendCommand("SET", "a", "1")
+	sendCommand("SET", "b", "2", "EX", "100")
+	if v := sendCommand("DEBUG", "RELOAD"); v.Str != "OK" {
+		t.Fatalf("Expected DEBUG RELOAD to succeed, got %+v", v)
+	}
+	if data, _ := os.ReadFile(snapshot); !strings.HasPrefix(string(data), "REDIS0009") {
+		t.Errorf("Expected a Redis RDB file, got %q", data)
+	}
+	if v := sendCommand("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to survive the reload, got %+v", v)
+	}
+	if v := sendCommand("TTL", "b"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected b to keep its TTL, got %+v", v)
+	}
+
+	// NOSAVE reloads the file as it is, MERGE keeps keys it lacks.
+	sendCommand("SET", "c", "3")
+	sendCommand("DEBUG", "RELOAD", "MERGE", "NOSAVE")
+	if v := sendCommand("GET", "c"); v.Str != "3" {
+		t.Errorf("Expected MERGE to keep c, got %+v", v)
+	}
+	sendCommand("DEBUG", "RELOAD", "NOSAVE")
+	if v := sendCommand("GET", "c"); !v.Null {
+		t.Errorf("Expected c to be gone after reloading without saving, got %+v", v)
+	}
+	if v := sendCommand("DEBUG", "RELOAD", "BOGUS"); v.Type != resp.Error {
+		t.Errorf("Expected a syntax error, got %+v", v)
+	}
+
+	sendCommand("CONFIG", "SET", "rdb-format", "zencache")
+	sendCommand("SAVE")
+	if data, _ := os.ReadFile(snapshot); !strings.HasPrefix(string(data), "ZENCACHE") {
+		t.Errorf("Expected CONFIG SET rdb-format to switch formats, got %q", data)
+	}
+	if v := sendCommand("CONFIG", "SET", "rdb-compression-level", "10"); v.Type != resp.Error {
+		t.Errorf("Expected an invalid compression level to be rejected, got %+v", v)
+	}
+	sendCommand("CONFIG", "SET", "rdb-compression-level", "6")
+	sendCommand("DEBUG", "RELOAD")
+	if v := sendCommand("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to survive a compressed reload, got %+v", v)
+	}
+
+	// A Redis file can seed a new server.
+	sendCommand("CONFIG", "SET", "rdb-format", "redis")
+	sendCommand("SAVE")
+	dump := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.Rename(snapshot, dump); err != nil {
+		t.Fatal(err)
+	}
+	cfg = server.DefaultConfig(6394)
+	cfg.ImportRDB = dump
+	sendCommand = start(cfg)
+	if v := sendCommand("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to be imported, got %+v", v)
+	}
+	if v := sendCommand("INFO", "persistence"); !strings.Contains(v.Str, "rdb_changes_since_last_save:2") {
+		t.Errorf("Expected imported keys to count as unsaved, got %q", v.Str)
+	}
+}
+
+func TestDataDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	start := func(port int, dbfilename string) func(args ...string) resp.Value {
+		cfg := server.DefaultConfig(port)
+		cfg.Save = nil
+		cfg.Dir = dir
+		cfg.DBFilename = dbfilename
+		return startServer(t, cfg)
+	}
+
+	sendCommand := start(6395, "first.rdb")
+	if v := sendCommand("CONFIG", "GET", "dir"); len(v.Array) != 2 || v.Array[1].Str != dir {
+		t.Errorf("Expected dir %s, got %+v", dir, v)
+	}
+	if v := sendCommand("CONFIG", "SET", "dbfilename", "../escape.rdb"); v.Type != resp.Error {
+		t.Errorf("Expected a path to be rejected as dbfilename, got %+v", v)
+	}
+	if v := sendCommand("CONFIG", "SET", "dir", filepath.Join(dir, "missing")); v.Type != resp.Error {
+		t.Errorf("Expected a missing directory to be rejected, got %+v", v)
+	}
+
+	sendCommand("CONFIG", "SET", "snapshot-history", "2")
+	for i := 0; i < 3; i++ {
+		sendCommand("SET", "generation", fmt.Sprint(i))
+		if v := sendCommand("SAVE"); v.Str != "OK" {
+			t.Fatalf("Expected SAVE to succeed, got %+v", v)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "first.rdb")); err != nil {
+		t.Errorf("Expected the snapshot in the data directory, got %v", err)
+	}
+	copies, _ := filepath.Glob(filepath.Join(dir, "first-*.rdb"))
+	if len(copies) != 2 {
+		t.Fatalf("Expected 2 timestamped copies, got %v", copies)
+	}
+
+	// Renaming the snapshot leaves the old one alone.
+	sendCommand("CONFIG", "SET", "dbfilename", "second.rdb")
+	sendCommand("SET", "generation", "renamed")
+	sendCommand("SAVE")
+	if _, err := os.Stat(filepath.Join(dir, "second.rdb")); err != nil {
+		t.Errorf("Expected SAVE to use the new file name, got %v", err)
+	}
+
+	// Any copy can be started from for a point-in-time restore.
+	sendCommand = start(6396, filepath.Base(copies[0]))
+	if v := sendCommand("GET", "generation"); v.Str != "1" {
+		t.Errorf("Expected the older copy to hold generation 1, got %+v", v)
+	}
+}
+
+func TestPartialResync(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6397))
+	replica := startServer(t, server.DefaultConfig(6398))
+
+	if v := replica("REPLICAOF", "localhost", "6397"); v.Str != "OK" {
+		t.Fatalf("Expected REPLICAOF to succeed, got %+v", v)
+	}
+	master("SET", "a", "1")
+	time.Sleep(50 * time.Millisecond)
+	if v := replica("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to be replicated, got %+v", v)
+	}
+	if id := infoField(master, "replication", "master_replid"); len(id) != 40 || infoField(replica, "replication", "master_replid") != id {
+		t.Errorf("Expected the replica to share the master's replication ID %q, got %q", id, infoField(replica, "replication", "master_replid"))
+	}
+
+	// Writes made while the link is down are sent from the backlog.
+	replica("REPLICAOF", "localhost", "1")
+	time.Sleep(50 * time.Millisecond)
+	if status := infoField(replica, "replication", "master_link_status"); status != "down" {
+		t.Fatalf("Expected the link to a closed port to be down, got %q", status)
+	}
+	master("SET", "b", "2")
+	master("DEL", "a")
+	replica("REPLICAOF", "localhost", "6397")
+	time.Sleep(50 * time.Millisecond)
+	if v := replica("GET", "b"); v.Str != "2" {
+		t.Errorf("Expected b to arrive after reconnecting, got %+v", v)
+	}
+	if v := replica("GET", "a"); !v.Null {
+		t.Errorf("Expected the DEL of a to arrive after reconnecting, got %+v", v)
+	}
+	if infoField(master, "replication", "sync_full") != "1" || infoField(master, "replication", "sync_partial_ok") != "1" {
+		t.Errorf("Expected one full and one partial sync, got %q and %q", infoField(master, "replication", "sync_full"), infoField(master, "replication", "sync_partial_ok"))
+	}
+	if offset := infoField(master, "replication", "master_repl_offset"); infoField(replica, "replication", "master_repl_offset") != offset {
+		t.Errorf("Expected the replica to reach offset %s, got %s", offset, infoField(replica, "replication", "master_repl_offset"))
+	}
+
+	// Once the backlog has moved past the replica it needs a full sync.
+	master("CONFIG", "SET", "repl-backlog-size", "16kb")
+	replica("REPLICAOF", "localhost", "1")
+	master("SET", "big", strings.Repeat("x", 20<<10))
+	failed := infoField(master, "replication", "sync_partial_err")
+	replica("REPLICAOF", "localhost", "6397")
+	time.Sleep(100 * time.Millisecond)
+	if infoField(master, "replication", "sync_full") != "2" || infoField(master, "replication", "sync_partial_err") == failed {
+		t.Errorf("Expected an overrun backlog to force a full sync, got %q full and %q failed partial", infoField(master, "replication", "sync_full"), infoField(master, "replication", "sync_partial_err"))
+	}
+}
+
+func TestFullResyncSnapshot(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6399))
+	replica := startServer(t, server.DefaultConfig(6400))
+
+	// Keys written before the replica attaches arrive in the snapshot.
+	for i := 0; i < 1000; i++ {
+		master("SET", fmt.Sprintf("key:%d", i), strings.Repeat("v", 100))
+	}
+	master("SET", "volatile", "v", "EX", "100")
+	replica("SET", "stale", "x")
+
+	if v := replica("REPLICAOF", "localhost", "6399"); v.Str != "OK" {
+		t.Fatalf("Expected REPLICAOF to succeed, got %+v", v)
+	}
+	// These may race with the snapshot; either way they must arrive.
+	master("SET", "key:0", "changed")
+	master("DEL", "key:1")
+	master("SET", "after", "1")
+	time.Sleep(200 * time.Millisecond)
+
+	if v := replica("INFO", "keyspace"); !strings.Contains(v.Str, "db0:keys=1001,expires=1") {
+		t.Errorf("Expected 1001 keys on the replica, got %q", v.Str)
+	}
+	if v := replica("GET", "stale"); !v.Null {
+		t.Errorf("Expected the replica's own keys to be replaced, got %+v", v)
+	}
+	if v := replica("GET", "key:999"); v.Str != strings.Repeat("v", 100) {
+		t.Errorf("Expected key:999 from the snapshot, got %+v", v)
+	}
+	if v := replica("TTL", "volatile"); v.Int <= 0 || v.Int > 100 {
+		t.Errorf("Expected volatile to keep its TTL, got %+v", v)
+	}
+	if v := replica("GET", "key:0"); v.Str != "changed" {
+		t.Errorf("Expected the write made during the sync, got %+v", v)
+	}
+	if v := replica("GET", "key:1"); !v.Null {
+		t.Errorf("Expected the DEL made during the sync, got %+v", v)
+	}
+	if v := replica("GET", "after"); v.Str != "1" {
+		t.Errorf("Expected the write made after the sync, got %+v", v)
+	}
+
+	master("SET", "later", "2")
+	time.Sleep(50 * time.Millisecond)
+	if v := replica("GET", "later"); v.Str != "2" {
+		t.Errorf("Expected the stream to continue after the snapshot, got %+v", v)
+	}
+	if offset := infoField(master, "replication", "master_repl_offset"); infoField(replica, "replication", "master_repl_offset") != offset {
+		t.Errorf("Expected the replica to reach offset %s, got %s", offset, infoField(replica, "replication", "master_repl_offset"))
+	}
+}
+
+// linkProxy forwards connections from one port to another, so a test can
+// break replication links and refuse new ones.
+type linkProxy struct {
+	from, to int
+	mu       sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+}
+
+func (p *linkProxy) listen(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.from))
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	p.mu.Lock()
+	p.listener = l
+	p.mu.Unlock()
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", fmt.Sprintf(":%d", p.to))
+			if err != nil {
+				in.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, in, out)
+			p.mu.Unlock()
+			go io.Copy(in, out)
+			go io.Copy(out, in)
+		}
+	}()
+}
+
+// cut closes every forwarded connection and, if refuse is set, stops
+// accepting new ones.
+func (p *linkProxy) cut(refuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if refuse {
+		p.listener.Close()
+	}
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func TestReplicaReconnects(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6401))
+	replica := startServer(t, server.DefaultConfig(6403))
+	proxy := &linkProxy{from: 6402, to: 6401}
+	proxy.listen(t)
+	t.Cleanup(func() { proxy.cut(true) })
+
+	replica("REPLICAOF", "localhost", "6402")
+	master("SET", "a", "1")
+	time.Sleep(100 * time.Millisecond)
+	if status := infoField(replica, "replication", "master_link_status"); status != "up" {
+		t.Fatalf("Expected the link to be up, got %q", status)
+	}
+	if v := replica("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected a to be replicated, got %+v", v)
+	}
+	if last := infoField(replica, "replication", "master_last_io_seconds_ago"); last != "0" {
+		t.Errorf("Expected recent I/O with the master, got %q", last)
+	}
+
+	// A dropped link is restored without a command and resumes partially.
+	proxy.cut(false)
+	time.Sleep(50 * time.Millisecond)
+	master("SET", "b", "2")
+	time.Sleep(300 * time.Millisecond)
+	if v := replica("GET", "b"); v.Str != "2" {
+		t.Errorf("Expected b to arrive after the link was restored, got %+v", v)
+	}
+	if infoField(master, "replication", "sync_full") != "1" || infoField(master, "replication", "sync_partial_ok") != "1" {
+		t.Errorf("Expected one full and one partial sync, got %q and %q", infoField(master, "replication", "sync_full"), infoField(master, "replication", "sync_partial_ok"))
+	}
+
+	// While the master is unreachable the link is reported down and retried.
+	proxy.cut(true)
+	time.Sleep(300 * time.Millisecond)
+	if status := infoField(replica, "replication", "master_link_status"); status != "down" {
+		t.Errorf("Expected the link to be down, got %q", status)
+	}
+	if since := infoField(replica, "replication", "master_link_down_since_seconds"); since != "0" {
+		t.Errorf("Expected the link to have just gone down, got %q", since)
+	}
+	master("SET", "c", "3")
+	proxy.listen(t)
+	time.Sleep(time.Second)
+	if status := infoField(replica, "replication", "master_link_status"); status != "up" {
+		t.Errorf("Expected the link to come back up, got %q", status)
+	}
+	if v := replica("GET", "c"); v.Str != "3" {
+		t.Errorf("Expected c to arrive once the master was reachable, got %+v", v)
+	}
+	if infoField(master, "replication", "sync_partial_ok") != "2" {
+		t.Errorf("Expected a second partial sync, got %q", infoField(master, "replication", "sync_partial_ok"))
+	}
+}
+
+func TestReplicaPromotion(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6404))
+	promoted := startServer(t, server.DefaultConfig(6405))
+	sibling := startServer(t, server.DefaultConfig(6406))
+
+	promoted("REPLICAOF", "localhost", "6404")
+	sibling("REPLICAOF", "localhost", "6404")
+	master("SET", "a", "1")
+	time.Sleep(100 * time.Millisecond)
+	oldID, offset := infoField(master, "replication", "master_replid"), infoField(master, "replication", "master_repl_offset")
+
+	if v := promoted("REPLICAOF", "NO", "ONE"); v.Str != "OK" {
+		t.Fatalf("Expected REPLICAOF NO ONE to succeed, got %+v", v)
+	}
+	if role := infoField(promoted, "replication", "role"); role != "master" {
+		t.Errorf("Expected the replica to become a master, got %q", role)
+	}
+	newID := infoField(promoted, "replication", "master_replid")
+	if newID == oldID || infoField(promoted, "replication", "master_replid2") != oldID {
+		t.Errorf("Expected a new ID with %s kept as the secondary, got %s and %s", oldID, newID, infoField(promoted, "replication", "master_replid2"))
+	}
+	if n, _ := strconv.Atoi(offset); infoField(promoted, "replication", "second_repl_offset") != strconv.Itoa(n+1) {
+		t.Errorf("Expected the secondary ID to be valid past offset %s, got %s", offset, infoField(promoted, "replication", "second_repl_offset"))
+	}
+
+	// A sibling that had not gone past the promotion follows the new
+	// master with a partial sync.
+	sibling("REPLICAOF", "localhost", "6405")
+	time.Sleep(100 * time.Millisecond)
+	if infoField(promoted, "replication", "sync_partial_ok") != "1" || infoField(promoted, "replication", "sync_full") != "0" {
+		t.Errorf("Expected the sibling to continue partially, got %q partial and %q full", infoField(promoted, "replication", "sync_partial_ok"), infoField(promoted, "replication", "sync_full"))
+	}
+	promoted("SET", "b", "3")
+	time.Sleep(50 * time.Millisecond)
+	if v := sibling("GET", "b"); v.Str != "3" {
+		t.Errorf("Expected b to reach the sibling, got %+v", v)
+	}
+	if id := infoField(sibling, "replication", "master_replid"); id != newID {
+		t.Errorf("Expected the sibling to take on the ID %s, got %s", newID, id)
+	}
+
+	// The promoted node no longer follows the old master.
+	master("SET", "a", "2")
+	time.Sleep(50 * time.Millisecond)
+	if v := promoted("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected writes to the old master to be ignored, got %+v", v)
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6407))
+	replica := startServer(t, server.DefaultConfig(6408))
+
+	replica("REPLICAOF", "localhost", "6407")
+	master("SET", "a", "1")
+	time.Sleep(100 * time.Millisecond)
+
+	for _, args := range [][]string{{"SET", "a", "2"}, {"del", "a"}, {"EXPIRE", "a", "10"}, {"PERSIST", "a"}} {
+		if v := replica(args...); v.Type != resp.Error || !strings.HasPrefix(v.Str, "READONLY ") {
+			t.Errorf("%v: expected a READONLY error, got %+v", args, v)
+		}
+	}
+	if v := replica("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected reads to be served, got %+v", v)
+	}
+	// The replication stream is still applied.
+	master("SET", "a", "3")
+	time.Sleep(50 * time.Millisecond)
+	if v := replica("GET", "a"); v.Str != "3" {
+		t.Errorf("Expected the master's write to be applied, got %+v", v)
+	}
+
+	if v := replica("CONFIG", "SET", "replica-read-only", "no"); v.Str != "OK" {
+		t.Fatalf("Expected CONFIG SET to succeed, got %+v", v)
+	}
+	if v := replica("SET", "local", "1"); v.Str != "OK" {
+		t.Errorf("Expected a writable replica to accept writes, got %+v", v)
+	}
+	replica("CONFIG", "SET", "replica-read-only", "yes")
+	replica("REPLICAOF", "NO", "ONE")
+	if v := replica("SET", "a", "4"); v.Str != "OK" {
+		t.Errorf("Expected a promoted replica to accept writes, got %+v", v)
+	}
+}
+
+func TestWaitForReplicas(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6409))
+	first := startServer(t, server.DefaultConfig(6410))
+	second := startServer(t, server.DefaultConfig(6411))
+
+	if v := master("WAIT", "0", "0"); v.Int != 0 || v.Type != resp.Integer {
+		t.Errorf("Expected WAIT 0 to return 0 at once, got %+v", v)
+	}
+	first("REPLICAOF", "localhost", "6409")
+	second("REPLICAOF", "localhost", "6409")
+	time.Sleep(100 * time.Millisecond)
+
+	master("SET", "a", "1")
+	began := time.Now()
+	if v := master("WAIT", "2", "1000"); v.Int != 2 {
+		t.Errorf("Expected both replicas to acknowledge, got %+v", v)
+	}
+	if elapsed := time.Since(began); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected WAIT to return once acknowledged, took %v", elapsed)
+	}
+	if v := first("GET", "a"); v.Str != "1" {
+		t.Errorf("Expected the acknowledged write on the replica, got %+v", v)
+	}
+	offset := infoField(master, "replication", "master_repl_offset")
+	stats := master("INFO", "replication").Str
+	for _, port := range []string{"6410", "6411"} {
+		if !strings.Contains(stats, "port="+port+",state=online,offset="+offset+",lag=0") {
+			t.Errorf("Expected replica %s to be online at offset %s, got:\n%s", port, offset, stats)
+		}
+	}
+
+	// A replica that has gone away cannot acknowledge.
+	second("REPLICAOF", "NO", "ONE")
+	time.Sleep(50 * time.Millisecond)
+	master("SET", "b", "2")
+	began = time.Now()
+	if v := master("WAIT", "2", "200"); v.Int != 1 {
+		t.Errorf("Expected one replica to acknowledge, got %+v", v)
+	}
+	if elapsed := time.Since(began); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected WAIT to wait for its timeout, took %v", elapsed)
+	}
+
+	if v := first("WAIT", "1", "0"); v.Type != resp.Error {
+		t.Errorf("Expected WAIT to be refused on a replica, got %+v", v)
+	}
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6412))
+	replica := startServer(t, server.DefaultConfig(6413))
+
+	replica("REPLICAOF", "localhost", "6412")
+	time.Sleep(100 * time.Millisecond)
+
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	master("SET", "a", "1")
+	master("SET", "b", "2", "EX", "100")
+	master("SET", "c", "3")
+	master("EXPIRE", "a", "200")
+	master("PEXPIREAT", "c", at)
+	master("PERSIST", "b")
+	master("SET", "d", "4")
+	master("DEL", "d")
+	master("EXPIRE", "nothing", "10") // changes nothing and is not sent
+	time.Sleep(100 * time.Millisecond)
+
+	if v := replica("TTL", "a"); v.Int <= 100 || v.Int > 200 {
+		t.Errorf("Expected EXPIRE to be replicated, got TTL %+v", v)
+	}
+	if v := replica("TTL", "b"); v.Int != -1 {
+		t.Errorf("Expected PERSIST to be replicated, got TTL %+v", v)
+	}
+	if v := replica("PTTL", "c"); v.Int <= 0 {
+		t.Errorf("Expected PEXPIREAT to be replicated, got PTTL %+v", v)
+	}
+	if v := replica("GET", "d"); !v.Null {
+		t.Errorf("Expected DEL to be replicated, got %+v", v)
+	}
+
+	// The master expires keys and sends DEL.
+	master("SET", "short", "v", "PX", "100")
+	time.Sleep(50 * time.Millisecond)
+	if v := replica("GET", "short"); v.Str != "v" {
+		t.Errorf("Expected short to be replicated, got %+v", v)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if keys := infoField(replica, "keyspace", "db0"); !strings.HasPrefix(keys, "keys=3,") {
+		t.Errorf("Expected the master's DEL to remove short from the replica, got %q", keys)
+	}
+	if n := infoField(master, "stats", "expired_keys"); n != "1" {
+		t.Errorf("Expected the master to expire short, got %q expired keys", n)
+	}
+	if offset := infoField(master, "replication", "master_repl_offset"); infoField(replica, "replication", "master_repl_offset") != offset {
+		t.Errorf("Expected the replica to reach offset %s, got %s", offset, infoField(replica, "replication", "master_repl_offset"))
+	}
+
+	// Cut off from its master, a replica keeps expired keys in memory
+	// rather than expiring them in the background, but no longer serves
+	// them.
+	master("SET", "stale", "v", "PX", "100")
+	time.Sleep(50 * time.Millisecond)
+	replica("REPLICAOF", "localhost", "1")
+	time.Sleep(300 * time.Millisecond)
+	if keys := infoField(replica, "keyspace", "db0"); !strings.HasPrefix(keys, "keys=4,") {
+		t.Errorf("Expected the replica to keep stale until told, got %q", keys)
+	}
+	if v := replica("GET", "stale"); !v.Null {
+		t.Errorf("Expected an expired key to read as missing, got %+v", v)
+	}
+}
+
+func TestConcurrentWritersPropagateInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	cfg := server.DefaultConfig(6415)
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.AppendFsync = aof.FsyncAlways
+	master := startServer(t, cfg)
+	replica := startServer(t, server.DefaultConfig(6416))
+	replica("REPLICAOF", "localhost", "6415")
+	time.Sleep(100 * time.Millisecond)
+
+	var conns []net.Conn
+	for w := 0; w < 8; w++ {
+		conn, err := net.Dial("tcp", ":6415")
+		if err != nil {
+			t.Fatalf("Could not connect to server: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// Writers race on the same key; whichever write wins must also be the
+	// last one logged and replicated.
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for w, conn := range conns {
+			wg.Add(1)
+			go func(w int, conn net.Conn) {
+				defer wg.Done()
+				reader := resp.NewReader(conn)
+				for i := 0; i < 10; i++ {
+					conn.Write(resp.EncodeCommand([]string{"SET", "k", fmt.Sprintf("%d-%d-%d", round, w, i)}))
+					if _, err := reader.ReadValue(); err != nil {
+						return
+					}
+				}
+			}(w, conn)
+		}
+		wg.Wait()
+
+		value := master("GET", "k").Str
+		var logged string
+		if _, err := aof.Load(path, func(args []string) {
+			if strings.EqualFold(args[0], "SET") {
+				logged = args[2]
+			}
+		}); err != nil {
+			t.Fatalf("Failed to load the append only file: %v", err)
+		}
+		if logged != value {
+			t.Fatalf("Expected the last logged SET to be %q, got %q", value, logged)
+		}
+		for i := 0; i < 100 && replica("GET", "k").Str != value; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if v := replica("GET", "k"); v.Str != value {
+			t.Fatalf("Expected the replica to end with %q, got %+v", value, v)
+		}
+	}
+}
+
+func TestExpiredKeysPropagateAfterTheirWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	cfg := server.DefaultConfig(6417)
+	cfg.AppendOnly = true
+	cfg.AppendFilename = path
+	cfg.AppendFsync = aof.FsyncAlways
+	master := startServer(t, cfg)
+
+	// A reader expires keys as soon as they are written; the DEL must
+	// still follow the SET in the log.
+	conn, err := net.Dial("tcp", ":6417")
+	if err != nil {
+		t.Fatalf("Could not connect to server: %v", err)
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader := resp.NewReader(conn)
+		for i := 0; i < 300; i++ {
+			for try := 0; try < 5; try++ {
+				conn.Write(resp.EncodeCommand([]string{"GET", fmt.Sprintf("k%d", i)}))
+				if _, err := reader.ReadValue(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		master("SET", fmt.Sprintf("k%d", i), "v", "PX", "1")
+	}
+	<-done
+	time.Sleep(200 * time.Millisecond)
+
+	set := make(map[string]bool)
+	if _, err := aof.Load(path, func(args []string) {
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			set[args[1]] = true
+		case "DEL":
+			if !set[args[1]] {
+				t.Errorf("Expected the DEL of %s to follow its SET", args[1])
+			}
+		}
+	}); err != nil {
+		t.Fatalf("Failed to load the append only file: %v", err)
+	}
+}
+
+func TestReplicaAppliesWritesOverItsLimit(t *testing.T) {
+	master := startServer(t, server.DefaultConfig(6418))
+	cfg := server.DefaultConfig(6419)
+	cfg.MaxMemoryPolicy = lru.NoEviction
+	cfg.Capacity = 1
+	replica := startServer(t, cfg)
+	replica("REPLICAOF", "localhost", "6418")
+	time.Sleep(100 * time.Millisecond)
+
+	master("SET", "a", "1")
+	master("SET", "b", "2")
+	master("SET", "c", "3")
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range []string{"a", "b", "c"} {
+		if v := replica("GET", key); v.Type != resp.BulkString || v.Null {
+			t.Errorf("Expected %s to be replicated over the limit, got %+v", key, v)
+		}
+	}
+}
+
+func TestEvictionsPropagateAsDel(t *testing.T) {
+	cfg := server.DefaultConfig(6420)
+	cfg.Capacity = 2
+	master := startServer(t, cfg)
+	cfg = server.DefaultConfig(6421)
+	cfg.Capacity = 1
+	replica := startServer(t, cfg)
+	replica("REPLICAOF", "localhost", "6420")
+	time.Sleep(100 * time.Millisecond)
+
+	// The replica holds what the master holds: it neither evicts under
+	// its own smaller limit nor keeps what the master evicted.
+	master("SET", "a", "1")
+	master("SET", "b", "2")
+	master("SET", "c", "3")
+	time.Sleep(100 * time.Millisecond)
+	kept := 0
+	for _, key := range []string{"a", "b", "c"} {
+		onMaster, onReplica := !master("GET", key).Null, !replica("GET", key).Null
+		if onMaster != onReplica {
+			t.Errorf("Expected %s on the replica only if on the master, got %v and %v", key, onReplica, onMaster)
+		}
+		if onReplica {
+			kept++
+		}
+	}
+	if kept != 2 {
+		t.Errorf("Expected the replica to keep 2 keys, got %d", kept)
+	}
+}
+
+func TestDebugReloadRefusedWhilePropagating(t *testing.T) {
+	cfg := server.DefaultConfig(6422)
+	cfg.AppendOnly = true
+	withAOF := startServer(t, cfg)
+	if v := withAOF("DEBUG", "RELOAD"); v.Type != resp.Error {
+		t.Errorf("Expected DEBUG RELOAD to be refused with the append only file on, got %+v", v)
+	}
+
+	master := startServer(t, server.DefaultConfig(6423))
+	replica := startServer(t, server.DefaultConfig(6424))
+	replica("REPLICAOF", "localhost", "6423")
+	time.Sleep(200 * time.Millisecond)
+	if v := master("DEBUG", "RELOAD"); v.Type != resp.Error {
+		t.Errorf("Expected DEBUG RELOAD to be refused on a master with replicas, got %+v", v)
+	}
+	if v := replica("DEBUG", "RELOAD"); v.Type != resp.Error {
+		t.Errorf("Expected DEBUG RELOAD to be refused on a replica, got %+v", v)
+	}
 }
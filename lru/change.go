@@ -0,0 +1,71 @@
+package lru
+
+// ChangeOp names the kind of a Change.
+type ChangeOp int
+
+const (
+	ChangeSet     ChangeOp = iota // Key now holds Value, expiring at ExpireAt
+	ChangeDel                     // Key was deleted
+	ChangeExpire                  // Key now expires at ExpireAt
+	ChangePersist                 // Key no longer expires
+	ChangeExpired                 // Key was removed because its deadline passed
+	ChangeEvicted                 // Key was removed to keep the cache within its limits
+)
+
+// Change describes one write to the cache. Replaying a shard's changes in
+// the order they are reported rebuilds its keys, so they can be logged or
+// sent to replicas as they happen.
+type Change struct {
+	Op       ChangeOp
+	Key      string
+	Value    string // set by ChangeSet
+	ExpireAt int64  // Unix milliseconds, set by ChangeSet and ChangeExpire; 0 means no expiry
+}
+
+// SetChangeHook registers fn to be called with every change made by Set,
+// SetWithOptions, Del, Expire and Persist, with every key evicted and with
+// every key removed because its deadline passed. Restore, LoadData and
+// Flush replace the data wholesale and report nothing.
+//
+// fn runs with the cache locked, so changes to a key are reported in the
+// order they were made. It must be quick and must not call back into the
+// cache. Keys expired by Get and ExpireTime are only queued, so reads never
+// wait for fn; they are reported by the next write or ReportExpired.
+func (c *Cache) SetChangeHook(fn func(Change)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = fn
+	c.expiredQueue = nil
+}
+
+// ReportExpired reports the keys expired by reads since the last write.
+func (c *Cache) ReportExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reportExpired()
+}
+
+// report passes ch to the change hook, if any, after the queued
+// expirations it follows. Callers must hold c.mu.
+func (c *Cache) report(ch Change) {
+	c.reportExpired()
+	if c.onChange != nil {
+		c.onChange(ch)
+	}
+}
+
+// queueExpired queues the expiration of key to be reported by the next
+// write. Callers must hold c.mu.
+func (c *Cache) queueExpired(key string) {
+	if c.onChange != nil {
+		c.expiredQueue = append(c.expiredQueue, key)
+	}
+}
+
+// reportExpired reports the queued expirations. Callers must hold c.mu.
+func (c *Cache) reportExpired() {
+	for _, key := range c.expiredQueue {
+		c.onChange(Change{Op: ChangeExpired, Key: key})
+	}
+	c.expiredQueue = nil
+}
@@ -0,0 +1,70 @@
+package lru
+
+import (
+	"time"
+)
+
+const (
+	// expireKeysPerLoop is how many keys with a deadline are sampled per
+	// iteration of the active expire cycle.
+	expireKeysPerLoop = 20
+	// expireAcceptableStale is the percentage of expired keys in a sample
+	// below which the cycle stops early.
+	expireAcceptableStale = 10
+)
+
+// ActiveExpireCycle reclaims expired keys that are never accessed again.
+// It repeatedly samples keys that have a deadline and removes the expired
+// ones, continuing while more than expireAcceptableStale percent of a sample
+// was expired and the time budget allows. The lock is released between
+// samples so clients are never blocked for longer than one sample. Returns
+// the number of keys removed.
+func (c *Cache) ActiveExpireCycle(budget time.Duration) int {
+	start := time.Now()
+	removed, sampled := 0, 0
+	timedOut := false
+
+	for {
+		c.mu.Lock()
+		at := now()
+		n, expired := 0, 0
+		for _, elem := range c.expires {
+			if n == expireKeysPerLoop {
+				break
+			}
+			n++
+			if elem.Value.(*entry).expired(at) {
+				c.removeExpired(elem)
+				expired++
+			}
+		}
+		c.reportExpired()
+		c.mu.Unlock()
+
+		removed += expired
+		sampled += n
+		if n == 0 || expired*100/n <= expireAcceptableStale {
+			break
+		}
+		if time.Since(start) > budget {
+			timedOut = true
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+	c.mu.Lock()
+	c.stats.ExpireCycles++
+	c.stats.ExpireCycleTime += elapsed
+	if timedOut {
+		c.stats.ExpireTimeCapReached++
+	}
+	if sampled > 0 {
+		// Smooth the estimate across cycles the way Redis does.
+		current := float64(removed) * 100 / float64(sampled)
+		c.stats.ExpiredStalePercent = current*0.05 + c.stats.ExpiredStalePercent*0.95
+	}
+	c.mu.Unlock()
+
+	return removed
+}
@@ -2,87 +2,440 @@ package lru
 
 import (
 	"container/list"
+	"sort"
 	"sync"
+	"time"
 )
 
-// Cache is a thread-safe LRU cache.
+// now returns the current time in Unix milliseconds. Tests replace it to
+// control expiry.
+var now = func() int64 {
+	return time.Now().UnixMilli()
+}
+
+// Now returns the current time in Unix milliseconds as the cache sees it.
+// Callers computing deadlines or remaining TTLs use it so they agree with
+// the cache on what has expired.
+func Now() int64 {
+	return now()
+}
+
+// restoreSlack sets how far Restore lets the cache grow past its limits,
+// as a fraction 1/restoreSlack of them, before evicting.
+const restoreSlack = 4
+
+// entryOverhead approximates the bytes an entry costs beyond its key and
+// value: the list element, the entry struct and its map slots.
+const entryOverhead = 112
+
+// Cache is a thread-safe LRU cache bounded by item count, estimated memory,
+// or both. Entries may carry an expiry deadline; expired entries are treated
+// as missing, removed lazily on access and reclaimed in the background by
+// ActiveExpireCycle.
 type Cache struct {
-	mu       sync.RWMutex
-	capacity int
-	items    map[string]*list.Element
-	order    *list.List // Front = most recently used, Back = least recently used
+	mu         sync.RWMutex
+	capacity   int   // maximum number of items, 0 means unlimited
+	maxMemory  int64 // maximum estimated bytes, 0 means unlimited
+	usedMemory int64
+	items      map[string]*list.Element
+	expires    map[string]*list.Element // subset of items that have a deadline
+	order      *list.List               // Front = most recently used, Back = least recently used
+	policy     Policy
+	tiny       *tinyLFU // segments for AllKeysWTinyLFU, nil under other policies
+	clock      uint64   // logical time of the most recent access
+	stats      Stats
+	onChange   func(Change)
+
+	expiredQueue []string // keys expired by reads, not yet reported
+	ignoreLimits bool
 }
 
 type entry struct {
-	key   string
-	value string
+	key        string
+	value      string
+	expireAt   int64  // Unix milliseconds, 0 means no expiry
+	lastUsed   uint64 // logical access time for LRU sampling
+	accessedAt int64  // Unix milliseconds of the last access, for LFU decay
+	freq       uint8  // logarithmic LFU counter
+
+	// W-TinyLFU bookkeeping, only maintained under AllKeysWTinyLFU.
+	segment segment
+	segElem *list.Element
+	weight  int64
 }
 
-// NewCache creates a new LRU cache with the given capacity.
+func (e *entry) expired(at int64) bool {
+	return e.expireAt != 0 && e.expireAt <= at
+}
+
+// size estimates the memory held by the entry.
+func (e *entry) size() int64 {
+	return int64(len(e.key)+len(e.value)) + entryOverhead
+}
+
+// Stats holds cumulative counters describing cache activity.
+type Stats struct {
+	ExpiredKeys          uint64        // keys removed because their deadline passed
+	ExpiredStalePercent  float64       // estimated percentage of expired keys still in memory
+	ExpireCycles         uint64        // active expire cycles run
+	ExpireCycleTime      time.Duration // total time spent in active expire cycles
+	ExpireTimeCapReached uint64        // cycles stopped because they ran out of budget
+	EvictedKeys          uint64        // keys removed to stay within capacity or memory limits
+	Hits                 uint64        // Get calls that found a live key
+	Misses               uint64        // Get calls that found nothing
+	Admitted             uint64        // W-TinyLFU window candidates admitted to the main cache
+	Rejected             uint64        // W-TinyLFU window candidates evicted by the admission filter
+}
+
+// Stats returns a snapshot of the cache's counters.
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stats
+}
+
+// SetOptions controls a conditional write made with SetWithOptions.
+type SetOptions struct {
+	ExpireAt int64 // Unix milliseconds; 0 clears any existing expiry
+	KeepTTL  bool  // retain the existing expiry instead of applying ExpireAt
+	NX       bool  // only set if the key does not exist
+	XX       bool  // only set if the key already exists
+}
+
+// ExpireCondition restricts when Expire changes a key's deadline.
+type ExpireCondition int
+
+const (
+	ExpireAlways ExpireCondition = iota
+	ExpireNX                     // only if the key has no expiry
+	ExpireXX                     // only if the key already has an expiry
+	ExpireGT                     // only if the new expiry is later
+	ExpireLT                     // only if the new expiry is sooner
+)
+
+// NewCache creates a new LRU cache with the given capacity. A capacity of 0
+// leaves the item count unbounded, which is useful together with
+// SetMaxMemory. The eviction policy defaults to AllKeysLRU.
 func NewCache(capacity int) *Cache {
 	return &Cache{
 		capacity: capacity,
 		items:    make(map[string]*list.Element),
+		expires:  make(map[string]*list.Element),
 		order:    list.New(),
 	}
 }
 
-// Set adds or updates a key-value pair. Returns evicted key if eviction occurred.
+// Set adds or updates a key-value pair, clearing any expiry. Returns evicted
+// key if eviction occurred.
 func (c *Cache) Set(key, value string) (evictedKey string, evicted bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	defer c.reportExpired()
+
+	return c.set(key, value, 0, false)
+}
+
+// SetWithOptions writes a key subject to opts. It returns the previous value
+// if the key existed and whether the write was performed.
+func (c *Cache) SetWithOptions(key, value string, opts SetOptions) (old string, existed bool, written bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.reportExpired()
+
+	if e := c.lookup(key); e != nil {
+		old, existed = e.value, true
+	}
+	if (opts.NX && existed) || (opts.XX && !existed) {
+		return old, existed, false
+	}
+	c.set(key, value, opts.ExpireAt, opts.KeepTTL)
+	return old, existed, true
+}
 
+// set stores a value. Callers must hold c.mu.
+func (c *Cache) set(key, value string, expireAt int64, keepTTL bool) (evictedKey string, evicted bool) {
+	var e *entry
 	if elem, ok := c.items[key]; ok {
 		// Key exists, update value and move to front
-		c.order.MoveToFront(elem)
-		elem.Value.(*entry).value = value
-		return "", false
-	}
-
-	// New key - check if we need to evict
-	if c.order.Len() >= c.capacity {
-		// Evict LRU (back of list)
-		oldest := c.order.Back()
-		if oldest != nil {
-			c.order.Remove(oldest)
-			evictedEntry := oldest.Value.(*entry)
-			delete(c.items, evictedEntry.key)
-			evictedKey = evictedEntry.key
-			evicted = true
+		c.touch(elem)
+		e = elem.Value.(*entry)
+		c.usedMemory += int64(len(value) - len(e.value))
+		e.value = value
+		if c.tiny != nil {
+			c.tiny.reweigh(c, e)
+		}
+		if !keepTTL || e.expired(now()) {
+			c.setExpire(elem, expireAt)
 		}
+	} else {
+		// Add new entry to front
+		c.clock++
+		e = &entry{key: key, value: value, lastUsed: c.clock, accessedAt: now(), freq: lfuInitVal}
+		elem := c.order.PushFront(e)
+		c.items[key] = elem
+		c.usedMemory += e.size()
+		c.setExpire(elem, expireAt)
+		if c.tiny != nil {
+			c.tiny.add(c, elem)
+		}
+	}
+	c.report(Change{Op: ChangeSet, Key: key, Value: value, ExpireAt: e.expireAt})
+
+	return c.evict()
+}
+
+// overLimit reports whether the cache exceeds its item or memory limit.
+// Callers must hold c.mu.
+func (c *Cache) overLimit() bool {
+	if c.ignoreLimits {
+		return false
 	}
+	return (c.capacity > 0 && c.order.Len() > c.capacity) ||
+		(c.maxMemory > 0 && c.usedMemory > c.maxMemory)
+}
 
-	// Add new entry to front
-	elem := c.order.PushFront(&entry{key: key, value: value})
-	c.items[key] = elem
+// evict removes entries chosen by the eviction policy until the cache is
+// within its limits or the policy has nothing left to evict. The most
+// recently used entry is never evicted, so a single value larger than the
+// memory limit is still stored. Returns the last evicted key. Callers must
+// hold c.mu.
+func (c *Cache) evict() (evictedKey string, evicted bool) {
+	for c.overLimit() {
+		elem := c.victim()
+		if elem == nil {
+			break
+		}
+		evictedKey = elem.Value.(*entry).key
+		evicted = true
+		c.remove(elem)
+		c.stats.EvictedKeys++
+		c.report(Change{Op: ChangeEvicted, Key: evictedKey})
+	}
+	if c.tiny != nil {
+		c.tiny.rebalance(c)
+	}
 	return evictedKey, evicted
 }
 
+// touch records an access to elem. Callers must hold c.mu.
+func (c *Cache) touch(elem *list.Element) {
+	c.order.MoveToFront(elem)
+	e := elem.Value.(*entry)
+	at := now()
+	c.clock++
+	e.lastUsed = c.clock
+	e.freq = lfuIncr(e.frequency(at))
+	e.accessedAt = at
+	if c.tiny != nil {
+		c.tiny.access(c, elem)
+	}
+}
+
+// SetCapacity sets the item limit, evicting immediately if the cache is
+// already above it. 0 removes the limit.
+func (c *Cache) SetCapacity(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacity = capacity
+	c.resetTinyLFU()
+	c.evict()
+}
+
+// Capacity returns the item limit, 0 if unlimited.
+func (c *Cache) Capacity() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capacity
+}
+
+// SetMaxMemory sets the memory limit in bytes, evicting immediately if the
+// cache is already above it. 0 removes the limit.
+func (c *Cache) SetMaxMemory(bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxMemory = bytes
+	c.resetTinyLFU()
+	c.evict()
+}
+
+// MaxMemory returns the memory limit in bytes, 0 if unlimited.
+func (c *Cache) MaxMemory() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxMemory
+}
+
+// UsedMemory returns the estimated bytes held by all entries.
+func (c *Cache) UsedMemory() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.usedMemory
+}
+
+// setExpire updates an entry's deadline and the volatile index. Callers
+// must hold c.mu.
+func (c *Cache) setExpire(elem *list.Element, expireAt int64) {
+	e := elem.Value.(*entry)
+	e.expireAt = expireAt
+	if expireAt != 0 {
+		c.expires[e.key] = elem
+	} else {
+		delete(c.expires, e.key)
+	}
+}
+
+// remove unlinks an entry from every index. Callers must hold c.mu.
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	c.usedMemory -= e.size()
+	if c.tiny != nil {
+		c.tiny.unlink(e)
+	}
+	c.order.Remove(elem)
+	delete(c.items, e.key)
+	delete(c.expires, e.key)
+}
+
+// lookup returns the live entry for key, removing it first if it has
+// expired. Callers must hold c.mu.
+func (c *Cache) lookup(key string) *entry {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if e.expireAt != 0 && e.expired(now()) {
+		c.removeExpired(elem)
+		return nil
+	}
+	return e
+}
+
+// removeExpired removes an entry whose deadline has passed. Callers must
+// hold c.mu.
+func (c *Cache) removeExpired(elem *list.Element) {
+	c.remove(elem)
+	c.stats.ExpiredKeys++
+	c.queueExpired(elem.Value.(*entry).key)
+}
+
 // Get retrieves a value by key and marks it as recently used.
 func (c *Cache) Get(key string) (string, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if elem, ok := c.items[key]; ok {
-		c.order.MoveToFront(elem)
-		return elem.Value.(*entry).value, true
+	if e := c.lookup(key); e != nil {
+		c.touch(c.items[key])
+		c.stats.Hits++
+		return e.value, true
+	}
+	c.stats.Misses++
+	if c.tiny != nil {
+		// Misses count towards popularity so a key requested repeatedly
+		// can win admission once it is written.
+		c.tiny.sketch.increment(key)
 	}
 	return "", false
 }
 
+// Expire sets the deadline of an existing key to at (Unix milliseconds) if
+// cond allows it. A deadline in the past deletes the key. Returns whether
+// the key was changed.
+func (c *Cache) Expire(key string, at int64, cond ExpireCondition) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.reportExpired()
+
+	e := c.lookup(key)
+	if e == nil {
+		return false
+	}
+	switch cond {
+	case ExpireNX:
+		if e.expireAt != 0 {
+			return false
+		}
+	case ExpireXX:
+		if e.expireAt == 0 {
+			return false
+		}
+	case ExpireGT:
+		// A key without expiry counts as an infinite TTL.
+		if e.expireAt == 0 || at <= e.expireAt {
+			return false
+		}
+	case ExpireLT:
+		if e.expireAt != 0 && at >= e.expireAt {
+			return false
+		}
+	}
+
+	if at <= now() {
+		c.remove(c.items[key])
+		c.report(Change{Op: ChangeDel, Key: key})
+		return true
+	}
+	c.setExpire(c.items[key], at)
+	c.report(Change{Op: ChangeExpire, Key: key, ExpireAt: at})
+	return true
+}
+
+// ExpireTime returns the deadline of key in Unix milliseconds, or 0 if it
+// has none. exists is false if the key is missing or already expired.
+func (c *Cache) ExpireTime(key string) (at int64, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.lookup(key); e != nil {
+		return e.expireAt, true
+	}
+	return 0, false
+}
+
+// Persist removes the expiry of key. Returns whether an expiry was removed.
+func (c *Cache) Persist(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.reportExpired()
+
+	if e := c.lookup(key); e != nil && e.expireAt != 0 {
+		c.setExpire(c.items[key], 0)
+		c.report(Change{Op: ChangePersist, Key: key})
+		return true
+	}
+	return false
+}
+
 // Del removes a key from the cache.
 func (c *Cache) Del(key string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	defer c.reportExpired()
 
-	if elem, ok := c.items[key]; ok {
-		c.order.Remove(elem)
-		delete(c.items, key)
+	if c.lookup(key) != nil {
+		c.remove(c.items[key])
+		c.report(Change{Op: ChangeDel, Key: key})
 		return true
 	}
 	return false
 }
 
+// Flush removes every key and returns how many there were.
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.order.Len()
+	c.items = make(map[string]*list.Element)
+	c.expires = make(map[string]*list.Element)
+	c.order.Init()
+	c.usedMemory = 0
+	c.resetTinyLFU()
+	return n
+}
+
 // Len returns the current number of items in the cache.
 func (c *Cache) Len() int {
 	c.mu.RLock()
@@ -90,6 +443,13 @@ func (c *Cache) Len() int {
 	return c.order.Len()
 }
 
+// ExpiresLen returns the number of items that have an expiry.
+func (c *Cache) ExpiresLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.expires)
+}
+
 // Keys returns all keys in order from most to least recently used.
 func (c *Cache) Keys() []string {
 	c.mu.RLock()
@@ -102,28 +462,172 @@ func (c *Cache) Keys() []string {
 	return keys
 }
 
-// GetAllData returns a copy of all data for persistence.
+// GetAllData returns a copy of all live data for persistence.
 func (c *Cache) GetAllData() map[string]string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	at := now()
 	data := make(map[string]string, len(c.items))
 	for k, v := range c.items {
-		data[k] = v.Value.(*entry).value
+		if e := v.Value.(*entry); !e.expired(at) {
+			data[k] = e.value
+		}
 	}
 	return data
 }
 
+// Record is a point-in-time copy of a live entry, used to persist the cache.
+type Record struct {
+	Key        string
+	Value      string
+	ExpireAt   int64 // Unix milliseconds, 0 means no expiry
+	AccessedAt int64 // Unix milliseconds of the last access, 0 if unknown
+	Freq       uint8 // logarithmic LFU counter as of AccessedAt
+}
+
+// Snapshot returns a copy of every live entry from least to most recently
+// used, so re-inserting the records in order restores recency.
+func (c *Cache) Snapshot() []Record {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snapshot()
+}
+
+// snapshot implements Snapshot. Callers must hold c.mu.
+func (c *Cache) snapshot() []Record {
+	at := now()
+	records := make([]Record, 0, c.order.Len())
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		if ent := e.Value.(*entry); !ent.expired(at) {
+			records = append(records, Record{ent.key, ent.value, ent.expireAt, ent.accessedAt, ent.freq})
+		}
+	}
+	return records
+}
+
+// Restore inserts a persisted record, keeping its expiry, last access time
+// and LFU counter. Records that have already expired are skipped and
+// Restore returns false. A record without an access time, as read from
+// formats that do not store one, is treated as a new entry. Records may be
+// restored in any order; FinishRestore must be called once all are in.
+//
+// Limits are enforced as records arrive, as far as the policy allows, so
+// loading a snapshot larger than the cache does not hold all of it in
+// memory. Sorting by access time on every record would be costly, so the
+// cache may grow past its limits by restoreSlack before it sorts and evicts
+// back down to them.
+func (c *Cache) Restore(r Record) bool {
+	at := now()
+	if r.ExpireAt != 0 && r.ExpireAt <= at {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Segments are rebuilt by FinishRestore.
+	c.dropTinyLFU()
+	if elem, ok := c.items[r.Key]; ok {
+		c.remove(elem)
+	}
+	e := &entry{key: r.Key, value: r.Value, accessedAt: r.AccessedAt, freq: r.Freq}
+	if e.accessedAt == 0 {
+		e.accessedAt, e.freq = at, lfuInitVal
+	}
+	elem := c.order.PushFront(e)
+	c.items[e.key] = elem
+	c.usedMemory += e.size()
+	c.setExpire(elem, r.ExpireAt)
+	if (c.capacity > 0 && c.order.Len() > c.capacity+c.capacity/restoreSlack) ||
+		(c.maxMemory > 0 && c.usedMemory > c.maxMemory+c.maxMemory/restoreSlack) {
+		c.orderByAccess()
+		c.evict()
+	}
+	return true
+}
+
+// FinishRestore completes a sequence of Restore calls. Entries are ordered
+// by last access time, so recency survives even if records arrived out of
+// order, then the eviction policy's state is rebuilt and the cache evicts
+// down to its limits.
+func (c *Cache) FinishRestore() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.orderByAccess()
+	c.resetTinyLFU()
+	c.evict()
+}
+
+// orderByAccess rebuilds the recency list from last access times, least
+// recently used at the back. Callers must hold c.mu.
+func (c *Cache) orderByAccess() {
+	entries := make([]*entry, 0, c.order.Len())
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, elem.Value.(*entry))
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].accessedAt < entries[j].accessedAt
+	})
+
+	c.order.Init()
+	for _, e := range entries {
+		c.clock++
+		e.lastUsed = c.clock
+		elem := c.order.PushFront(e)
+		c.items[e.key] = elem
+		if e.expireAt != 0 {
+			c.expires[e.key] = elem
+		}
+	}
+}
+
+// emptyCopy returns an empty cache with c's limits and policy.
+func (c *Cache) emptyCopy() *Cache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	fresh := NewCache(c.capacity)
+	fresh.maxMemory = c.maxMemory
+	fresh.policy = c.policy
+	fresh.ignoreLimits = c.ignoreLimits
+	fresh.resetTinyLFU()
+	return fresh
+}
+
+// swapData replaces c's entries with those of from, which must no longer
+// be used. Expirations still queued for the old entries are reported
+// first. Callers must hold c.mu.
+func (c *Cache) swapData(from *Cache) {
+	c.reportExpired()
+	c.items, c.expires, c.order = from.items, from.expires, from.order
+	c.usedMemory, c.clock = from.usedMemory, from.clock
+	c.tiny = from.tiny
+	c.stats.EvictedKeys += from.stats.EvictedKeys
+	if c.policy != from.policy {
+		// The policy changed during the load.
+		c.resetTinyLFU()
+	}
+}
+
 // LoadData bulk loads data into the cache (used for restoring from persistence).
 func (c *Cache) LoadData(data map[string]string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	at := now()
 	for key, value := range data {
-		if c.order.Len() >= c.capacity {
+		e := &entry{key: key, value: value, accessedAt: at, freq: lfuInitVal}
+		if (c.capacity > 0 && c.order.Len() >= c.capacity) ||
+			(c.maxMemory > 0 && c.usedMemory+e.size() > c.maxMemory) {
 			break // Stop loading if at capacity
 		}
-		elem := c.order.PushBack(&entry{key: key, value: value})
-		c.items[key] = elem
+		if elem, ok := c.items[key]; ok {
+			c.remove(elem)
+		}
+		c.items[key] = c.order.PushBack(e)
+		c.usedMemory += e.size()
 	}
+	c.resetTinyLFU()
 }
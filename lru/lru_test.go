@@ -1,7 +1,11 @@
 package lru
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLRUBasicOperations(t *testing.T) {
@@ -56,6 +60,37 @@ func TestLRUEviction(t *testing.T) {
 	}
 }
 
+func TestLRUIgnoreLimits(t *testing.T) {
+	cache := NewCache(2)
+	var evicted []string
+	cache.SetChangeHook(func(ch Change) {
+		if ch.Op == ChangeEvicted {
+			evicted = append(evicted, ch.Key)
+		}
+	})
+
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	cache.Set("c", "3")
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("Expected the hook to report evicting 'a', got %v", evicted)
+	}
+
+	cache.SetIgnoreLimits(true)
+	cache.Set("d", "4")
+	if cache.Len() != 3 || len(evicted) != 1 {
+		t.Errorf("Expected no eviction while ignoring limits, got len %d and %v", cache.Len(), evicted)
+	}
+	if err := cache.FreeMemory(); err != nil {
+		t.Errorf("Expected no error while ignoring limits, got %v", err)
+	}
+
+	cache.SetIgnoreLimits(false)
+	if cache.Len() != 2 || len(evicted) != 2 || evicted[1] != "b" {
+		t.Errorf("Expected enforcing limits again to evict 'b', got len %d and %v", cache.Len(), evicted)
+	}
+}
+
 func TestLRUUpdate(t *testing.T) {
 	cache := NewCache(3)
 
@@ -95,3 +130,532 @@ func TestLRUDel(t *testing.T) {
 		t.Error("Expected Del of nonexistent key to return false")
 	}
 }
+
+// fakeClock replaces the package clock for the duration of a test.
+func fakeClock(t *testing.T, start int64) *int64 {
+	clock := start
+	orig := now
+	now = func() int64 { return clock }
+	t.Cleanup(func() { now = orig })
+	return &clock
+}
+
+func TestLRUExpiry(t *testing.T) {
+	clock := fakeClock(t, 1000)
+	cache := NewCache(3)
+	var expired []string
+	cache.SetChangeHook(func(ch Change) {
+		if ch.Op == ChangeExpired {
+			expired = append(expired, ch.Key)
+		}
+	})
+
+	cache.SetWithOptions("a", "1", SetOptions{ExpireAt: 1500})
+	cache.Set("b", "2")
+
+	if at, ok := cache.ExpireTime("a"); !ok || at != 1500 {
+		t.Errorf("Expected expiry 1500, got %d (exists=%v)", at, ok)
+	}
+
+	*clock = 1500
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected 'a' to be expired")
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Expected expired key to be removed, got len %d", cache.Len())
+	}
+	if _, ok := cache.Get("b"); !ok {
+		t.Error("Expected 'b' to exist")
+	}
+	if len(expired) != 0 {
+		t.Errorf("Expected a read to only queue the expiration, got %v", expired)
+	}
+	cache.ReportExpired()
+	if len(expired) != 1 || expired[0] != "a" {
+		t.Errorf("Expected the hook to report 'a', got %v", expired)
+	}
+
+	// Deleting a key through a past deadline is not an expiration.
+	cache.Expire("b", 1000, ExpireAlways)
+	if len(expired) != 1 {
+		t.Errorf("Expected no further expirations, got %v", expired)
+	}
+}
+
+func TestChangeHook(t *testing.T) {
+	clock := fakeClock(t, 1000)
+	cache := NewCache(10)
+	var changes []Change
+	cache.SetChangeHook(func(ch Change) { changes = append(changes, ch) })
+
+	cache.SetWithOptions("a", "1", SetOptions{ExpireAt: 2000})
+	cache.SetWithOptions("a", "2", SetOptions{KeepTTL: true})
+	cache.SetWithOptions("a", "3", SetOptions{NX: true})
+	cache.Expire("a", 3000, ExpireAlways)
+	cache.Persist("a")
+	cache.Persist("a")
+	cache.Expire("a", 1000, ExpireAlways)
+	cache.Set("b", "1")
+	cache.Del("b")
+	cache.Del("b")
+	cache.SetWithOptions("c", "1", SetOptions{ExpireAt: 1500})
+	*clock = 1500
+	cache.Get("c")
+	// The expiration is reported ahead of the next write.
+	cache.SetWithOptions("c", "2", SetOptions{})
+
+	expected := []Change{
+		{Op: ChangeSet, Key: "a", Value: "1", ExpireAt: 2000},
+		{Op: ChangeSet, Key: "a", Value: "2", ExpireAt: 2000},
+		{Op: ChangeExpire, Key: "a", ExpireAt: 3000},
+		{Op: ChangePersist, Key: "a"},
+		{Op: ChangeDel, Key: "a"},
+		{Op: ChangeSet, Key: "b", Value: "1"},
+		{Op: ChangeDel, Key: "b"},
+		{Op: ChangeSet, Key: "c", Value: "1", ExpireAt: 1500},
+		{Op: ChangeExpired, Key: "c"},
+		{Op: ChangeSet, Key: "c", Value: "2"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestLRUSetOptions(t *testing.T) {
+	fakeClock(t, 1000)
+	cache := NewCache(3)
+
+	if _, _, written := cache.SetWithOptions("a", "1", SetOptions{XX: true}); written {
+		t.Error("Expected XX on missing key to be skipped")
+	}
+	if _, _, written := cache.SetWithOptions("a", "1", SetOptions{NX: true, ExpireAt: 5000}); !written {
+		t.Error("Expected NX on missing key to write")
+	}
+	old, existed, written := cache.SetWithOptions("a", "2", SetOptions{NX: true})
+	if written || !existed || old != "1" {
+		t.Errorf("Expected NX on existing key to be skipped, got old=%q existed=%v written=%v", old, existed, written)
+	}
+
+	cache.SetWithOptions("a", "3", SetOptions{KeepTTL: true})
+	if at, _ := cache.ExpireTime("a"); at != 5000 {
+		t.Errorf("Expected KEEPTTL to retain expiry, got %d", at)
+	}
+
+	cache.Set("a", "4")
+	if at, _ := cache.ExpireTime("a"); at != 0 {
+		t.Errorf("Expected plain Set to clear expiry, got %d", at)
+	}
+}
+
+func TestLRUExpireConditions(t *testing.T) {
+	fakeClock(t, 1000)
+	cache := NewCache(3)
+	cache.Set("a", "1")
+
+	if cache.Expire("a", 5000, ExpireXX) {
+		t.Error("Expected XX to fail on key without expiry")
+	}
+	if cache.Expire("a", 5000, ExpireGT) {
+		t.Error("Expected GT to fail on key without expiry")
+	}
+	if !cache.Expire("a", 5000, ExpireNX) {
+		t.Error("Expected NX to succeed on key without expiry")
+	}
+	if cache.Expire("a", 4000, ExpireGT) {
+		t.Error("Expected GT to fail for an earlier deadline")
+	}
+	if !cache.Expire("a", 4000, ExpireLT) {
+		t.Error("Expected LT to succeed for an earlier deadline")
+	}
+	if !cache.Persist("a") || cache.Persist("a") {
+		t.Error("Expected Persist to succeed exactly once")
+	}
+
+	if !cache.Expire("a", 999, ExpireAlways) {
+		t.Error("Expected past deadline to succeed")
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected past deadline to delete the key")
+	}
+}
+
+func TestLRUActiveExpireCycle(t *testing.T) {
+	clock := fakeClock(t, 1000)
+	cache := NewCache(1000)
+
+	for i := 0; i < 500; i++ {
+		cache.SetWithOptions(fmt.Sprintf("volatile:%d", i), "v", SetOptions{ExpireAt: 2000})
+	}
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("live:%d", i), "v")
+	}
+
+	if removed := cache.ActiveExpireCycle(time.Second); removed != 0 {
+		t.Errorf("Expected nothing to expire yet, removed %d", removed)
+	}
+
+	hooked := 0
+	cache.SetChangeHook(func(ch Change) {
+		if ch.Op == ChangeExpired {
+			hooked++
+		}
+	})
+	*clock = 2000
+	if removed := cache.ActiveExpireCycle(time.Second); removed != 500 || hooked != 500 {
+		t.Errorf("Expected all 500 expired keys to be reclaimed and reported, removed %d and reported %d", removed, hooked)
+	}
+	if cache.Len() != 100 || cache.ExpiresLen() != 0 {
+		t.Errorf("Expected 100 live keys and no volatile keys, got %d and %d", cache.Len(), cache.ExpiresLen())
+	}
+
+	stats := cache.Stats()
+	if stats.ExpiredKeys != 500 {
+		t.Errorf("Expected 500 expired keys in stats, got %d", stats.ExpiredKeys)
+	}
+	if stats.ExpireCycles != 2 {
+		t.Errorf("Expected 2 expire cycles, got %d", stats.ExpireCycles)
+	}
+}
+
+func TestLRUMemoryEviction(t *testing.T) {
+	cache := NewCache(0)
+	value := strings.Repeat("x", 1000)
+	perEntry := int64(len("k0")+len(value)) + entryOverhead
+	cache.SetMaxMemory(3 * perEntry)
+
+	cache.Set("k0", value)
+	cache.Set("k1", value)
+	cache.Set("k2", value)
+	if cache.UsedMemory() != 3*perEntry {
+		t.Errorf("Expected used memory %d, got %d", 3*perEntry, cache.UsedMemory())
+	}
+
+	cache.Get("k0")
+	evictedKey, evicted := cache.Set("k3", value)
+	if !evicted || evictedKey != "k1" {
+		t.Errorf("Expected 'k1' to be evicted, got '%s'", evictedKey)
+	}
+
+	// Many tiny values fit where a few large ones did not
+	for i := 0; i < 20; i++ {
+		cache.Set(fmt.Sprintf("t%d", i), "v")
+	}
+	if cache.UsedMemory() > cache.MaxMemory() {
+		t.Errorf("Used memory %d exceeds limit %d", cache.UsedMemory(), cache.MaxMemory())
+	}
+	if cache.Len() <= 3 {
+		t.Errorf("Expected small entries to pack more items, got %d", cache.Len())
+	}
+
+	// Growing a value in place also triggers eviction
+	cache.Set("t19", strings.Repeat("y", int(3*perEntry)))
+	if cache.Len() != 1 {
+		t.Errorf("Expected only the oversized entry to remain, got %d items", cache.Len())
+	}
+
+	cache.Del("t19")
+	if cache.UsedMemory() != 0 {
+		t.Errorf("Expected used memory 0 after delete, got %d", cache.UsedMemory())
+	}
+}
+
+func TestPolicyNames(t *testing.T) {
+	for _, name := range []string{"allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl", "noeviction"} {
+		p, err := ParsePolicy(name)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", name, err)
+		}
+		if p.String() != name {
+			t.Errorf("Expected %s, got %s", name, p)
+		}
+	}
+	if _, err := ParsePolicy("most-recent"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	cache := NewCache(5)
+	cache.SetPolicy(AllKeysLFU)
+
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	// Every key but k2 becomes popular
+	for n := 0; n < 200; n++ {
+		for _, k := range []string{"k0", "k1", "k3", "k4"} {
+			cache.Get(k)
+		}
+	}
+
+	evictedKey, evicted := cache.Set("new", "v")
+	if !evicted || evictedKey != "k2" {
+		t.Errorf("Expected rarely used 'k2' to be evicted, got '%s'", evictedKey)
+	}
+}
+
+func TestVolatilePolicies(t *testing.T) {
+	fakeClock(t, 1000)
+	cache := NewCache(4)
+	cache.SetPolicy(VolatileTTL)
+
+	cache.Set("persistent", "v")
+	cache.SetWithOptions("late", "v", SetOptions{ExpireAt: 9000})
+	cache.SetWithOptions("soon", "v", SetOptions{ExpireAt: 5000})
+	cache.Set("other", "v")
+
+	evictedKey, _ := cache.Set("new", "v")
+	if evictedKey != "soon" {
+		t.Errorf("Expected key with nearest expiry to be evicted, got '%s'", evictedKey)
+	}
+
+	cache.SetPolicy(VolatileLRU)
+	evictedKey, _ = cache.Set("newer", "v")
+	if evictedKey != "late" {
+		t.Errorf("Expected only volatile key to be evicted, got '%s'", evictedKey)
+	}
+
+	// No volatile keys are left, so nothing can be evicted
+	if _, evicted := cache.Set("newest", "v"); evicted {
+		t.Error("Expected no eviction without volatile keys")
+	}
+	if err := cache.FreeMemory(); err != ErrOutOfMemory {
+		t.Errorf("Expected ErrOutOfMemory, got %v", err)
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	cache := NewCache(2)
+	cache.SetPolicy(NoEviction)
+
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	if err := cache.FreeMemory(); err != nil {
+		t.Errorf("Expected room at capacity, got %v", err)
+	}
+	if _, evicted := cache.Set("c", "3"); evicted {
+		t.Error("Expected noeviction to keep every key")
+	}
+	if err := cache.FreeMemory(); err != ErrOutOfMemory {
+		t.Errorf("Expected ErrOutOfMemory, got %v", err)
+	}
+
+	cache.SetPolicy(AllKeysRandom)
+	if err := cache.FreeMemory(); err != nil {
+		t.Errorf("Expected random eviction to make room, got %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %d", cache.Len())
+	}
+}
+
+// hotSetHitRatio replays a workload where a hot set is read in round-robin
+// while a scan of one-hit keys streams through the cache, and returns the
+// hit ratio observed on the hot set.
+func hotSetHitRatio(policy Policy) float64 {
+	cache := NewCache(200)
+	cache.SetPolicy(policy)
+
+	const hot = 150
+	read := func(key string) bool {
+		if _, ok := cache.Get(key); ok {
+			return true
+		}
+		cache.Set(key, "v")
+		return false
+	}
+
+	// Warm up the hot set
+	for round := 0; round < 5; round++ {
+		for i := 0; i < hot; i++ {
+			read(fmt.Sprintf("hot:%d", i))
+		}
+	}
+
+	hits, reads := 0, 0
+	for scan := 0; scan < 20000; scan++ {
+		read(fmt.Sprintf("scan:%d", scan))
+		if scan%2 == 0 {
+			reads++
+			if read(fmt.Sprintf("hot:%d", (scan/2)%hot)) {
+				hits++
+			}
+		}
+	}
+	return float64(hits) / float64(reads)
+}
+
+func TestWTinyLFUScanResistance(t *testing.T) {
+	lruRatio := hotSetHitRatio(AllKeysLRU)
+	tinyRatio := hotSetHitRatio(AllKeysWTinyLFU)
+	t.Logf("hot set hit ratio: allkeys-lru=%.2f allkeys-wtinylfu=%.2f", lruRatio, tinyRatio)
+
+	if tinyRatio < 0.9 {
+		t.Errorf("Expected W-TinyLFU to keep the hot set through a scan, hit ratio %.2f", tinyRatio)
+	}
+	if tinyRatio <= lruRatio {
+		t.Errorf("Expected W-TinyLFU (%.2f) to beat LRU (%.2f)", tinyRatio, lruRatio)
+	}
+}
+
+func TestWTinyLFUBookkeeping(t *testing.T) {
+	cache := NewCache(50)
+	for i := 0; i < 40; i++ {
+		cache.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	// Switching policy at runtime adopts the existing entries
+	cache.SetPolicy(AllKeysWTinyLFU)
+
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("k%d", i%120)
+		if _, ok := cache.Get(key); !ok {
+			cache.Set(key, "v")
+		}
+		if i%7 == 0 {
+			cache.Del(fmt.Sprintf("k%d", i%13))
+		}
+	}
+
+	if cache.Len() > 50 {
+		t.Errorf("Expected at most 50 items, got %d", cache.Len())
+	}
+	tiny := cache.tiny
+	segLen := tiny.window.Len() + tiny.probation.Len() + tiny.protected.Len()
+	if segLen != cache.Len() {
+		t.Errorf("Expected segments to hold %d entries, got %d", cache.Len(), segLen)
+	}
+	if w := tiny.windowWeight + tiny.probationWeight + tiny.protectedWeight; w != int64(cache.Len()) {
+		t.Errorf("Expected total weight %d, got %d", cache.Len(), w)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses != 500 {
+		t.Errorf("Expected 500 lookups in stats, got %d", stats.Hits+stats.Misses)
+	}
+
+	cache.SetPolicy(AllKeysLRU)
+	if cache.tiny != nil {
+		t.Error("Expected W-TinyLFU segments to be dropped")
+	}
+}
+
+func TestWTinyLFUSketchKeepsHistory(t *testing.T) {
+	cache := NewCache(0)
+	cache.SetMaxMemory(1 << 20)
+	cache.SetPolicy(AllKeysWTinyLFU)
+
+	cache.Set("hot", "v")
+	for i := 0; i < 10; i++ {
+		cache.Get("hot")
+	}
+	// Outgrowing the sketch several times must not forget the hot key.
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	if cache.tiny.sketch.width < 1000 {
+		t.Fatalf("Expected the sketch to grow with the cache, width %d", cache.tiny.sketch.width)
+	}
+	if n := cache.tiny.sketch.estimate("hot"); n < 10 {
+		t.Errorf("Expected the hot key's frequency to survive growth, got %d", n)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	clock := fakeClock(t, 1000)
+	src := NewCache(0)
+	for i := 0; i < 5; i++ {
+		*clock += 10
+		src.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	src.Expire("k2", 5000, ExpireAlways)
+	src.Expire("k3", 1100, ExpireAlways)
+	*clock += 10
+	for n := 0; n < 50; n++ {
+		src.Get("k0")
+	}
+	*clock += 10
+
+	records := src.Snapshot()
+	*clock = 1100 // k3 expires while the server is down
+
+	// Restore in reverse to show that order comes from access times.
+	dst := NewCache(3)
+	for i := len(records) - 1; i >= 0; i-- {
+		dst.Restore(records[i])
+	}
+	dst.FinishRestore()
+
+	// k0 was used last, k3 has expired and k1 is evicted to fit.
+	keys := dst.Keys()
+	expected := []string{"k0", "k4", "k2"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v after restore, got %v", expected, keys)
+	}
+	if at, _ := dst.ExpireTime("k2"); at != 5000 {
+		t.Errorf("Expected k2 to keep its expiry, got %d", at)
+	}
+	if dst.ExpiresLen() != 1 {
+		t.Errorf("Expected only k2 to be volatile, got %d", dst.ExpiresLen())
+	}
+	if e := dst.items["k0"].Value.(*entry); e.freq <= lfuInitVal || e.accessedAt != 1060 {
+		t.Errorf("Expected k0 to keep its access time and LFU counter, got %d at %d", e.freq, e.accessedAt)
+	}
+	if dst.UsedMemory() != 3*(2+1+entryOverhead) {
+		t.Errorf("Expected memory accounting for 3 entries, got %d", dst.UsedMemory())
+	}
+
+	// Records without metadata become fresh entries.
+	if !dst.Restore(Record{Key: "plain", Value: "v"}) {
+		t.Fatal("Expected plain record to be restored")
+	}
+	if e := dst.items["plain"].Value.(*entry); e.accessedAt != 1100 || e.freq != lfuInitVal {
+		t.Errorf("Expected a fresh entry, got freq %d at %d", e.freq, e.accessedAt)
+	}
+	if dst.Restore(Record{Key: "stale", Value: "v", ExpireAt: 1100}) {
+		t.Error("Expected an expired record to be skipped")
+	}
+
+	// A snapshot larger than the cache is evicted while it loads.
+	for _, policy := range []Policy{AllKeysLRU, AllKeysWTinyLFU} {
+		small := NewCache(100)
+		small.SetPolicy(policy)
+		peak := 0
+		for i := 0; i < 1000; i++ {
+			small.Restore(Record{Key: fmt.Sprintf("r%d", i), Value: "v", AccessedAt: int64(i + 1), Freq: lfuInitVal})
+			peak = max(peak, small.Len())
+		}
+		small.FinishRestore()
+		if peak > 125 {
+			t.Errorf("%v: expected at most 125 entries while restoring, peaked at %d", policy, peak)
+		}
+		if keys := small.Keys(); len(keys) != 100 || keys[0] != "r999" || keys[99] != "r900" {
+			t.Errorf("%v: expected the 100 most recently used records, got %v", policy, keys)
+		}
+	}
+
+	// Restoring over live W-TinyLFU entries rebuilds its segments.
+	tiny := NewCache(10)
+	tiny.SetPolicy(AllKeysWTinyLFU)
+	tiny.Set("k0", "old")
+	tiny.Set("other", "v")
+	for _, r := range records {
+		tiny.Restore(r)
+	}
+	tiny.FinishRestore()
+	if v, _ := tiny.Get("k0"); v != "v" {
+		t.Errorf("Expected restored value to replace the live one, got %q", v)
+	}
+	segs := tiny.tiny
+	if n := segs.window.Len() + segs.probation.Len() + segs.protected.Len(); n != tiny.Len() {
+		t.Errorf("Expected W-TinyLFU segments to hold %d entries, got %d", tiny.Len(), n)
+	}
+
+	// Flushing before a reload leaves an empty, usable cache.
+	if n := tiny.Flush(); n != 5 || tiny.Len() != 0 || tiny.ExpiresLen() != 0 || tiny.UsedMemory() != 0 {
+		t.Errorf("Expected 5 keys flushed and nothing left, got %d, %d keys, %d bytes", n, tiny.Len(), tiny.UsedMemory())
+	}
+	tiny.Set("k0", "v")
+	if v, ok := tiny.Get("k0"); !ok || v != "v" {
+		t.Errorf("Expected the flushed cache to accept writes, got %q", v)
+	}
+}
@@ -0,0 +1,261 @@
+package lru
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+// Policy selects which entry is evicted when the cache is over its limits.
+type Policy int
+
+const (
+	AllKeysLRU      Policy = iota // least recently used of all keys
+	AllKeysLFU                    // least frequently used of all keys
+	AllKeysRandom                 // any key
+	VolatileLRU                   // least recently used of the keys with an expiry
+	VolatileLFU                   // least frequently used of the keys with an expiry
+	VolatileRandom                // any key with an expiry
+	VolatileTTL                   // the key with the nearest expiry
+	NoEviction                    // never evict; writes fail once over the limit
+	AllKeysWTinyLFU               // W-TinyLFU admission with a segmented LRU main cache
+)
+
+var policyNames = []string{
+	AllKeysLRU:      "allkeys-lru",
+	AllKeysLFU:      "allkeys-lfu",
+	AllKeysRandom:   "allkeys-random",
+	VolatileLRU:     "volatile-lru",
+	VolatileLFU:     "volatile-lfu",
+	VolatileRandom:  "volatile-random",
+	VolatileTTL:     "volatile-ttl",
+	NoEviction:      "noeviction",
+	AllKeysWTinyLFU: "allkeys-wtinylfu",
+}
+
+// String returns the policy's configuration name.
+func (p Policy) String() string {
+	if p >= 0 && int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy converts a configuration name such as "allkeys-lfu" to a
+// Policy.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if n == name {
+			return Policy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid eviction policy '%s'", name)
+}
+
+// ErrOutOfMemory is returned by FreeMemory when the cache is over its limit
+// and the policy cannot make room.
+var ErrOutOfMemory = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+const (
+	// evictionSamples is how many candidates the sampling policies compare
+	// when choosing a victim.
+	evictionSamples = 5
+
+	// LFU counters are 8-bit and grow logarithmically: the more hits a key
+	// has, the less likely the next hit increments the counter. New keys
+	// start at lfuInitVal so they are not evicted before they can be used,
+	// and counters decay by one every lfuDecayMinutes without access.
+	lfuInitVal      = 5
+	lfuLogFactor    = 10
+	lfuDecayMinutes = 1
+)
+
+// lfuIncr probabilistically increments a logarithmic frequency counter.
+func lfuIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// frequency returns the entry's LFU counter after applying decay for the
+// time since it was last accessed.
+func (e *entry) frequency(at int64) uint8 {
+	periods := (at - e.accessedAt) / 60000 / lfuDecayMinutes
+	if periods >= int64(e.freq) {
+		return 0
+	}
+	return e.freq - uint8(periods)
+}
+
+// victim picks the entry to evict next under the current policy, never
+// choosing the most recently used entry. Returns nil if nothing can be
+// evicted. Callers must hold c.mu.
+func (c *Cache) victim() *list.Element {
+	front := c.order.Front()
+
+	policy := c.policy
+	if policy == AllKeysWTinyLFU && c.tiny == nil {
+		// The segments are dropped during a restore and rebuilt when it
+		// finishes; until then evict in LRU order.
+		policy = AllKeysLRU
+	}
+	switch policy {
+	case AllKeysLRU:
+		if back := c.order.Back(); back != front {
+			return back
+		}
+		return nil
+	case NoEviction:
+		return nil
+	case AllKeysWTinyLFU:
+		return c.tiny.victim(c)
+	}
+
+	pool := c.items
+	if c.policy == VolatileLRU || c.policy == VolatileLFU || c.policy == VolatileRandom || c.policy == VolatileTTL {
+		pool = c.expires
+	}
+
+	// Map iteration starts at a random position, which gives a cheap
+	// random sample.
+	at := now()
+	var best *list.Element
+	sampled := 0
+	for _, elem := range pool {
+		if elem == front {
+			continue
+		}
+		if best == nil || c.better(elem.Value.(*entry), best.Value.(*entry), at) {
+			best = elem
+		}
+		sampled++
+		if sampled == evictionSamples || c.policy == AllKeysRandom || c.policy == VolatileRandom {
+			break
+		}
+	}
+	return best
+}
+
+// better reports whether a is a better eviction candidate than b.
+func (c *Cache) better(a, b *entry, at int64) bool {
+	switch c.policy {
+	case AllKeysLFU, VolatileLFU:
+		fa, fb := a.frequency(at), b.frequency(at)
+		if fa != fb {
+			return fa < fb
+		}
+		return a.lastUsed < b.lastUsed
+	case VolatileTTL:
+		return a.expireAt < b.expireAt
+	}
+	return a.lastUsed < b.lastUsed
+}
+
+// SetPolicy changes the eviction policy.
+func (c *Cache) SetPolicy(p Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = p
+	c.resetTinyLFU()
+}
+
+// resetTinyLFU rebuilds or drops the W-TinyLFU segments after the policy or
+// limits change. Callers must hold c.mu.
+func (c *Cache) resetTinyLFU() {
+	c.dropTinyLFU()
+	if c.policy == AllKeysWTinyLFU {
+		c.tiny = newTinyLFU(c)
+	}
+}
+
+// dropTinyLFU discards the W-TinyLFU segments, if any. Callers must hold
+// c.mu.
+func (c *Cache) dropTinyLFU() {
+	if c.tiny == nil {
+		return
+	}
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*entry).segElem = nil
+	}
+	c.tiny = nil
+}
+
+// Policy returns the eviction policy.
+func (c *Cache) Policy() Policy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.policy
+}
+
+// FreeMemory evicts entries until the cache is within its limits. It
+// returns ErrOutOfMemory if the policy cannot free enough, in which case
+// callers should refuse writes that would grow the cache.
+func (c *Cache) FreeMemory() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict()
+	if c.overLimit() {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// evictOne removes one entry chosen by the eviction policy and reports
+// whether it could. Sharded calls it to enforce limits spanning shards.
+// Unlike evict it may take the most recently used entry if front is set,
+// for shards other than the one just written to.
+func (c *Cache) evictOne(front bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ignoreLimits {
+		return false
+	}
+	elem := c.victim()
+	if elem == nil {
+		mru := c.order.Front()
+		if !front || mru == nil || !c.evictable(mru.Value.(*entry)) {
+			return false
+		}
+		elem = mru
+	}
+	c.remove(elem)
+	c.stats.EvictedKeys++
+	c.report(Change{Op: ChangeEvicted, Key: elem.Value.(*entry).key})
+	if c.tiny != nil {
+		c.tiny.rebalance(c)
+	}
+	return true
+}
+
+// SetIgnoreLimits sets whether the item and memory limits are ignored.
+// While they are, every write is stored and nothing is evicted; a replica
+// applies its master's evictions instead. Enforcing them again evicts
+// whatever is over.
+func (c *Cache) SetIgnoreLimits(ignore bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ignoreLimits = ignore
+	c.evict()
+}
+
+// evictable reports whether the policy allows e to be evicted at all.
+func (c *Cache) evictable(e *entry) bool {
+	switch c.policy {
+	case NoEviction:
+		return false
+	case VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL:
+		return e.expireAt != 0
+	}
+	return true
+}
@@ -0,0 +1,540 @@
+package lru
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sharded spreads keys over independent Cache segments selected by hash so
+// concurrent clients rarely contend on the same lock. Item and memory limits
+// are divided evenly between shards, which makes eviction approximately
+// rather than strictly global.
+type Sharded struct {
+	seed   maphash.Seed
+	shards []*Cache
+
+	mu           sync.RWMutex // guards the global limits below
+	capacity     int
+	maxMemory    int64
+	ignoreLimits bool
+}
+
+// NewSharded creates a cache of n shards holding at most capacity items in
+// total. n is clamped to at least 1.
+func NewSharded(n, capacity int) *Sharded {
+	if n < 1 {
+		n = 1
+	}
+	s := &Sharded{
+		seed:     maphash.MakeSeed(),
+		shards:   make([]*Cache, n),
+		capacity: capacity,
+	}
+	for i := range s.shards {
+		s.shards[i] = NewCache(s.split(int64(capacity), i))
+	}
+	return s
+}
+
+// split divides a global limit between shards, giving any remainder to the
+// first shards. A limit of 0 stays unlimited.
+func (s *Sharded) split(limit int64, i int) int {
+	n := int64(len(s.shards))
+	if limit == 0 {
+		return 0
+	}
+	part := limit / n
+	if int64(i) < limit%n {
+		part++
+	}
+	if part == 0 {
+		part = 1
+	}
+	return int(part)
+}
+
+func (s *Sharded) shard(key string) *Cache {
+	return s.shards[s.index(key)]
+}
+
+// index returns the position of key's shard.
+func (s *Sharded) index(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+// ShardCount returns the number of shards.
+func (s *Sharded) ShardCount() int {
+	return len(s.shards)
+}
+
+// Set adds or updates a key-value pair, clearing any expiry. Only evictions
+// from the key's own shard are reported.
+func (s *Sharded) Set(key, value string) (evictedKey string, evicted bool) {
+	c := s.shard(key)
+	evictedKey, evicted = c.Set(key, value)
+	s.enforceLimits(c)
+	return evictedKey, evicted
+}
+
+// SetWithOptions writes a key subject to opts.
+func (s *Sharded) SetWithOptions(key, value string, opts SetOptions) (old string, existed bool, written bool) {
+	c := s.shard(key)
+	old, existed, written = c.SetWithOptions(key, value, opts)
+	if written {
+		s.enforceLimits(c)
+	}
+	return old, existed, written
+}
+
+// Get retrieves a value by key and marks it as recently used.
+func (s *Sharded) Get(key string) (string, bool) {
+	return s.shard(key).Get(key)
+}
+
+// Del removes a key from the cache.
+func (s *Sharded) Del(key string) bool {
+	return s.shard(key).Del(key)
+}
+
+// Expire sets the deadline of an existing key if cond allows it.
+func (s *Sharded) Expire(key string, at int64, cond ExpireCondition) bool {
+	return s.shard(key).Expire(key, at, cond)
+}
+
+// ExpireTime returns the deadline of key in Unix milliseconds.
+func (s *Sharded) ExpireTime(key string) (at int64, exists bool) {
+	return s.shard(key).ExpireTime(key)
+}
+
+// Persist removes the expiry of key.
+func (s *Sharded) Persist(key string) bool {
+	return s.shard(key).Persist(key)
+}
+
+// Flush removes every key and returns how many there were.
+func (s *Sharded) Flush() int {
+	n := 0
+	for _, c := range s.shards {
+		n += c.Flush()
+	}
+	return n
+}
+
+// Len returns the current number of items in the cache.
+func (s *Sharded) Len() int {
+	n := 0
+	for _, c := range s.shards {
+		n += c.Len()
+	}
+	return n
+}
+
+// ExpiresLen returns the number of items that have an expiry.
+func (s *Sharded) ExpiresLen() int {
+	n := 0
+	for _, c := range s.shards {
+		n += c.ExpiresLen()
+	}
+	return n
+}
+
+// UsedMemory returns the estimated bytes held by all entries.
+func (s *Sharded) UsedMemory() int64 {
+	var n int64
+	for _, c := range s.shards {
+		n += c.UsedMemory()
+	}
+	return n
+}
+
+// SetCapacity sets the total item limit. 0 removes the limit.
+func (s *Sharded) SetCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.capacity = capacity
+	for i, c := range s.shards {
+		c.SetCapacity(s.split(int64(capacity), i))
+	}
+	s.enforceLimitsLocked(nil)
+}
+
+// Capacity returns the total item limit, 0 if unlimited.
+func (s *Sharded) Capacity() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.capacity
+}
+
+// SetMaxMemory sets the total memory limit in bytes. 0 removes the limit.
+func (s *Sharded) SetMaxMemory(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxMemory = bytes
+	for i, c := range s.shards {
+		c.SetMaxMemory(int64(s.split(bytes, i)))
+	}
+	s.enforceLimitsLocked(nil)
+}
+
+// MaxMemory returns the total memory limit in bytes, 0 if unlimited.
+func (s *Sharded) MaxMemory() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxMemory
+}
+
+// SetPolicy changes the eviction policy of every shard.
+func (s *Sharded) SetPolicy(p Policy) {
+	for _, c := range s.shards {
+		c.SetPolicy(p)
+	}
+}
+
+// Policy returns the eviction policy.
+func (s *Sharded) Policy() Policy {
+	return s.shards[0].Policy()
+}
+
+// FreeMemory evicts from every shard and returns ErrOutOfMemory if the
+// cache as a whole is still over its limits.
+func (s *Sharded) FreeMemory() error {
+	for _, c := range s.shards {
+		c.FreeMemory()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enforceLimitsLocked(nil)
+}
+
+// enforceLimits evicts until the cache as a whole is within its limits
+// after a write to shard written. See enforceLimitsLocked.
+func (s *Sharded) enforceLimits(written *Cache) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enforceLimitsLocked(written)
+}
+
+// SetIgnoreLimits sets whether every shard ignores the limits. See
+// Cache.SetIgnoreLimits.
+func (s *Sharded) SetIgnoreLimits(ignore bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ignoreLimits = ignore
+	for _, c := range s.shards {
+		c.SetIgnoreLimits(ignore)
+	}
+	s.enforceLimitsLocked(nil)
+}
+
+// ReportExpired reports the keys every shard expired on reads. See
+// Cache.ReportExpired.
+func (s *Sharded) ReportExpired() {
+	for _, c := range s.shards {
+		c.ReportExpired()
+	}
+}
+
+// enforceLimitsLocked evicts from the fullest shards until the global
+// limits are met, returning ErrOutOfMemory if the policy cannot. Every
+// shard may hold at least one item, so with more shards than items allowed
+// the shards can be within their own limits while the cache is not. The
+// most recently used entry of written, the one just written, is kept.
+// Callers must hold s.mu.
+func (s *Sharded) enforceLimitsLocked(written *Cache) error {
+	if s.ignoreLimits {
+		return nil
+	}
+	for {
+		overItems := s.capacity > 0 && s.Len() > s.capacity
+		overMemory := s.maxMemory > 0 && s.UsedMemory() > s.maxMemory
+		if !overItems && !overMemory {
+			return nil
+		}
+		if !s.evictFromFullest(overMemory, written) {
+			return ErrOutOfMemory
+		}
+	}
+}
+
+// evictFromFullest evicts one entry from the shard holding the most items,
+// or the most memory if byMemory is set, falling back to emptier shards
+// when the policy finds nothing to evict. The most recently used entry of
+// keep is never taken. Returns false if no shard could evict.
+func (s *Sharded) evictFromFullest(byMemory bool, keep *Cache) bool {
+	size := func(c *Cache) int64 {
+		if byMemory {
+			return c.UsedMemory()
+		}
+		return int64(c.Len())
+	}
+	shards := append([]*Cache(nil), s.shards...)
+	sort.Slice(shards, func(i, j int) bool {
+		return size(shards[i]) > size(shards[j])
+	})
+	for _, c := range shards {
+		if size(c) > 0 && c.evictOne(c != keep) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveExpireCycle runs the active expire cycle on every shard, sharing
+// the time budget between them. Returns the number of keys removed.
+func (s *Sharded) ActiveExpireCycle(budget time.Duration) int {
+	removed := 0
+	for _, c := range s.shards {
+		removed += c.ActiveExpireCycle(budget / time.Duration(len(s.shards)))
+	}
+	return removed
+}
+
+// Stats returns the counters of all shards combined.
+func (s *Sharded) Stats() Stats {
+	var total Stats
+	for _, c := range s.shards {
+		st := c.Stats()
+		total.ExpiredKeys += st.ExpiredKeys
+		total.ExpiredStalePercent += st.ExpiredStalePercent / float64(len(s.shards))
+		total.ExpireCycles += st.ExpireCycles
+		total.ExpireCycleTime += st.ExpireCycleTime
+		total.ExpireTimeCapReached += st.ExpireTimeCapReached
+		total.EvictedKeys += st.EvictedKeys
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Admitted += st.Admitted
+		total.Rejected += st.Rejected
+	}
+	// Every shard runs once per cycle; report whole-cache cycles.
+	total.ExpireCycles /= uint64(len(s.shards))
+	return total
+}
+
+// Keys returns all keys from most to least recently used. Shards are merged
+// by last access time, so keys touched within the same millisecond in
+// different shards may appear in either order.
+func (s *Sharded) Keys() []string {
+	lists := make(accessHeap, 0, len(s.shards))
+	total := 0
+	for _, c := range s.shards {
+		if keys := c.keysByAccess(); len(keys) > 0 {
+			lists = append(lists, keys)
+			total += len(keys)
+		}
+	}
+
+	heap.Init(&lists)
+	keys := make([]string, 0, total)
+	for lists.Len() > 0 {
+		head := lists[0]
+		keys = append(keys, head[0].key)
+		if len(head) == 1 {
+			heap.Pop(&lists)
+		} else {
+			lists[0] = head[1:]
+			heap.Fix(&lists, 0)
+		}
+	}
+	return keys
+}
+
+// GetAllData returns a copy of all live data for persistence.
+func (s *Sharded) GetAllData() map[string]string {
+	data := make(map[string]string)
+	for _, c := range s.shards {
+		for k, v := range c.GetAllData() {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// Walk calls fn with every live entry, stopping at the first error. Shards
+// are copied one at a time, so only a single shard is duplicated in memory
+// and writers are blocked only while their own shard is copied. Each shard
+// is consistent, but the walk as a whole is not an atomic snapshot.
+func (s *Sharded) Walk(fn func(Record) error) error {
+	for _, c := range s.shards {
+		for _, r := range c.Snapshot() {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restore inserts a persisted record into its shard. See Cache.Restore.
+func (s *Sharded) Restore(r Record) bool {
+	return s.shard(r.Key).Restore(r)
+}
+
+// Replace swaps the whole dataset for the records load passes to restore,
+// which behaves like Restore. The new dataset is built in empty shards on
+// the side while clients keep using the old one, then swapped in with every
+// shard locked, so no client sees part of each. If load fails the old
+// dataset is kept. Replace reports nothing to the change hook and returns
+// the number of keys replaced.
+func (s *Sharded) Replace(load func(restore func(Record) bool) error) (replaced int, err error) {
+	fresh, err := s.build(load)
+	if err != nil {
+		return 0, err
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	return s.swapAll(fresh), nil
+}
+
+// Reload replaces the dataset like Replace, but with every shard locked
+// from start to finish, so fn sees the dataset no write can change before
+// it is replaced. fn may read the old dataset through walk, which behaves
+// like Walk, and builds the new one through restore. It must not otherwise
+// use the cache.
+func (s *Sharded) Reload(fn func(walk func(func(Record) error) error, restore func(Record) bool) error) (replaced int, err error) {
+	// The empty shards are made first, since making them locks the live ones.
+	fresh := s.emptyShards()
+	s.lockAll()
+	defer s.unlockAll()
+
+	walk := func(visit func(Record) error) error {
+		for _, c := range s.shards {
+			for _, r := range c.snapshot() {
+				if err := visit(r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := s.fill(fresh, func(restore func(Record) bool) error { return fn(walk, restore) }); err != nil {
+		return 0, err
+	}
+	return s.swapAll(fresh), nil
+}
+
+// build loads a new dataset into empty shards shaped like the live ones.
+func (s *Sharded) build(load func(restore func(Record) bool) error) ([]*Cache, error) {
+	fresh := s.emptyShards()
+	if err := s.fill(fresh, load); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// emptyShards returns empty copies of the shards.
+func (s *Sharded) emptyShards() []*Cache {
+	fresh := make([]*Cache, len(s.shards))
+	for i, c := range s.shards {
+		fresh[i] = c.emptyCopy()
+	}
+	return fresh
+}
+
+// fill restores the records load passes to restore into fresh.
+func (s *Sharded) fill(fresh []*Cache, load func(restore func(Record) bool) error) error {
+	err := load(func(r Record) bool {
+		return fresh[s.index(r.Key)].Restore(r)
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range fresh {
+		c.FinishRestore()
+	}
+	return nil
+}
+
+// swapAll swaps the data of fresh into the shards and returns how many keys
+// they held. Callers must hold every shard's lock.
+func (s *Sharded) swapAll(fresh []*Cache) (replaced int) {
+	for i, c := range s.shards {
+		replaced += c.order.Len()
+		c.swapData(fresh[i])
+	}
+	return replaced
+}
+
+// lockAll locks every shard, in order.
+func (s *Sharded) lockAll() {
+	for _, c := range s.shards {
+		c.mu.Lock()
+	}
+}
+
+// unlockAll unlocks every shard.
+func (s *Sharded) unlockAll() {
+	for _, c := range s.shards {
+		c.mu.Unlock()
+	}
+}
+
+// SetChangeHook registers fn with every shard. See Cache.SetChangeHook.
+// Changes to one key are reported in order; changes to keys in different
+// shards may be reported concurrently.
+func (s *Sharded) SetChangeHook(fn func(Change)) {
+	for _, c := range s.shards {
+		c.SetChangeHook(fn)
+	}
+}
+
+// FinishRestore completes a sequence of Restore calls on every shard.
+func (s *Sharded) FinishRestore() {
+	for _, c := range s.shards {
+		c.FinishRestore()
+	}
+}
+
+// LoadData bulk loads data into the cache.
+func (s *Sharded) LoadData(data map[string]string) {
+	parts := make([]map[string]string, len(s.shards))
+	for i := range parts {
+		parts[i] = make(map[string]string)
+	}
+	for k, v := range data {
+		parts[s.index(k)][k] = v
+	}
+	for i, c := range s.shards {
+		c.LoadData(parts[i])
+	}
+}
+
+// keyAccess pairs a key with its last access time.
+type keyAccess struct {
+	key        string
+	accessedAt int64
+}
+
+// keysByAccess returns keys from most to least recently used along with
+// their last access time.
+func (c *Cache) keysByAccess() []keyAccess {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]keyAccess, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*entry)
+		keys = append(keys, keyAccess{ent.key, ent.accessedAt})
+	}
+	return keys
+}
+
+// accessHeap merges per-shard recency lists, most recent head first.
+type accessHeap [][]keyAccess
+
+func (h accessHeap) Len() int            { return len(h) }
+func (h accessHeap) Less(i, j int) bool  { return h[i][0].accessedAt > h[j][0].accessedAt }
+func (h accessHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *accessHeap) Push(x interface{}) { *h = append(*h, x.([]keyAccess)) }
+func (h *accessHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
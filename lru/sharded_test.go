@@ -0,0 +1,309 @@
+package lru
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedBasicOperations(t *testing.T) {
+	cache := NewSharded(8, 1000)
+
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", i))
+	}
+	if cache.Len() != 100 {
+		t.Errorf("Expected 100 items, got %d", cache.Len())
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := cache.Get(fmt.Sprintf("key:%d", i)); !ok || v != fmt.Sprintf("%d", i) {
+			t.Errorf("Expected '%d', got '%s'", i, v)
+		}
+	}
+
+	if !cache.Del("key:5") || cache.Del("key:5") {
+		t.Error("Expected Del to succeed exactly once")
+	}
+	if stats := cache.Stats(); stats.Hits != 100 {
+		t.Errorf("Expected 100 hits across shards, got %d", stats.Hits)
+	}
+}
+
+func TestShardedApproximateEviction(t *testing.T) {
+	cache := NewSharded(4, 100)
+
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+	if cache.Len() > 100 {
+		t.Errorf("Expected at most 100 items, got %d", cache.Len())
+	}
+	if cache.Len() < 90 {
+		t.Errorf("Expected shards to fill close to capacity, got %d", cache.Len())
+	}
+
+	cache.SetCapacity(0)
+	cache.SetMaxMemory(10 * 1024)
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+	if cache.UsedMemory() > cache.MaxMemory() {
+		t.Errorf("Used memory %d exceeds limit %d", cache.UsedMemory(), cache.MaxMemory())
+	}
+
+	cache.SetPolicy(NoEviction)
+	cache.SetMaxMemory(1024)
+	if err := cache.FreeMemory(); err != ErrOutOfMemory {
+		t.Errorf("Expected ErrOutOfMemory, got %v", err)
+	}
+}
+
+func TestShardedCapacityBelowShardCount(t *testing.T) {
+	cache := NewSharded(16, 3)
+
+	// Every shard allows one item, so only the global limit keeps the
+	// cache at three; writes must evict rather than fail.
+	for i := 0; i < 100; i++ {
+		if err := cache.FreeMemory(); err != nil {
+			t.Fatalf("SET %d: expected eviction, got %v", i, err)
+		}
+		cache.Set(fmt.Sprintf("key:%d", i), "v")
+		if n := cache.Len(); n > 3 {
+			t.Fatalf("SET %d: expected at most 3 items, got %d", i, n)
+		}
+	}
+	if _, ok := cache.Get("key:99"); !ok {
+		t.Error("Expected the newest key to be kept")
+	}
+
+	cache.SetCapacity(10)
+	for i := 0; i < 100; i++ {
+		cache.FreeMemory()
+		cache.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+	cache.SetCapacity(2)
+	if n := cache.Len(); n != 2 {
+		t.Errorf("Expected CONFIG SET capacity to evict down to 2, got %d items", n)
+	}
+
+	cache.SetPolicy(VolatileLRU)
+	cache.SetCapacity(1)
+	if err := cache.FreeMemory(); err != ErrOutOfMemory {
+		t.Errorf("Expected ErrOutOfMemory without volatile keys, got %v", err)
+	}
+}
+
+func TestShardedIgnoreLimits(t *testing.T) {
+	cache := NewSharded(4, 2)
+	cache.SetIgnoreLimits(true)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+	if err := cache.FreeMemory(); err != nil || cache.Len() != 10 {
+		t.Errorf("Expected 10 items and no error while ignoring limits, got %d and %v", cache.Len(), err)
+	}
+
+	cache.SetIgnoreLimits(false)
+	if n := cache.Len(); n > 2 {
+		t.Errorf("Expected enforcing limits again to evict down to 2, got %d items", n)
+	}
+}
+
+func TestShardedReplace(t *testing.T) {
+	cache := NewSharded(4, 100)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("old:%d", i), "v")
+	}
+
+	// Until the load completes, clients see only the old dataset.
+	replaced, err := cache.Replace(func(restore func(Record) bool) error {
+		for i := 0; i < 5; i++ {
+			restore(Record{Key: fmt.Sprintf("new:%d", i), Value: "v"})
+			if _, ok := cache.Get(fmt.Sprintf("new:%d", i)); ok {
+				t.Fatalf("Expected new:%d to be hidden until the load completes", i)
+			}
+		}
+		if cache.Len() != 10 {
+			t.Fatalf("Expected the old dataset during the load, got %d keys", cache.Len())
+		}
+		return nil
+	})
+	if err != nil || replaced != 10 {
+		t.Fatalf("Expected 10 keys replaced, got %d, %v", replaced, err)
+	}
+	if _, ok := cache.Get("old:0"); ok || cache.Len() != 5 {
+		t.Errorf("Expected only the 5 new keys, got %d keys", cache.Len())
+	}
+
+	loadErr := errors.New("load failed")
+	_, err = cache.Replace(func(restore func(Record) bool) error {
+		restore(Record{Key: "partial", Value: "v"})
+		return loadErr
+	})
+	if err != loadErr {
+		t.Errorf("Expected the load error, got %v", err)
+	}
+	if _, ok := cache.Get("partial"); ok || cache.Len() != 5 {
+		t.Errorf("Expected a failed load to keep the dataset, got %d keys", cache.Len())
+	}
+}
+
+func TestShardedReload(t *testing.T) {
+	cache := NewSharded(4, 100)
+	cache.Set("a", "1")
+
+	written := make(chan struct{})
+	_, err := cache.Reload(func(walk func(func(Record) error) error, restore func(Record) bool) error {
+		go func() {
+			cache.Set("b", "2")
+			close(written)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-written:
+			t.Error("Expected writes to wait for the reload")
+		default:
+		}
+		walk(func(r Record) error {
+			restore(r)
+			return nil
+		})
+		restore(Record{Key: "c", Value: "3"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	<-written
+	for _, key := range []string{"a", "b", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Expected %s after the reload", key)
+		}
+	}
+}
+
+func TestShardedKeysOrder(t *testing.T) {
+	clock := fakeClock(t, 1000)
+	cache := NewSharded(4, 100)
+
+	for i := 0; i < 10; i++ {
+		*clock++
+		cache.Set(fmt.Sprintf("k%d", i), "v")
+	}
+	*clock++
+	cache.Get("k3")
+
+	keys := cache.Keys()
+	expected := []string{"k3", "k9", "k8", "k7", "k6", "k5", "k4", "k2", "k1", "k0"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestShardedConcurrentAccess(t *testing.T) {
+	cache := NewSharded(16, 500)
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key:%d", (g*7919+i)%1000)
+				if _, ok := cache.Get(key); !ok {
+					cache.Set(key, "v")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if cache.Len() > 500 {
+		t.Errorf("Expected at most 500 items, got %d", cache.Len())
+	}
+}
+
+// getter is the read path shared by Cache and Sharded.
+type getter interface {
+	Get(key string) (string, bool)
+	Set(key, value string) (string, bool)
+}
+
+// benchmarkReads measures a read-heavy workload (90% GET, 10% SET) from
+// parallel goroutines. Run with -cpu 1,2,4,8 to see how throughput scales
+// with GOMAXPROCS.
+func benchmarkReads(b *testing.B, cache getter) {
+	const keys = 10000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key:%d", i)
+		cache.Set(names[i], "value")
+	}
+
+	// Each goroutine starts at a different offset so they do not walk the
+	// same shards in lockstep.
+	var offset atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(offset.Add(keys / 8))
+		for pb.Next() {
+			key := names[(i*7919)%keys]
+			if i%10 == 0 {
+				cache.Set(key, "value")
+			} else {
+				cache.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	benchmarkReads(b, NewCache(100000))
+}
+
+func BenchmarkShardedParallel(b *testing.B) {
+	for _, n := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			benchmarkReads(b, NewSharded(n, 100000))
+		})
+	}
+}
+
+func TestShardedWalk(t *testing.T) {
+	fakeClock(t, 1000)
+	cache := NewSharded(4, 0)
+
+	for i := 0; i < 50; i++ {
+		cache.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("%d", i))
+	}
+	cache.Expire("key:1", 5000, ExpireAlways)
+	cache.Expire("key:2", 1000, ExpireAlways) // already expired
+
+	seen := make(map[string]Record)
+	err := cache.Walk(func(r Record) error {
+		seen[r.Key] = r
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(seen) != 49 {
+		t.Errorf("Expected 49 live records, got %d", len(seen))
+	}
+	if r := seen["key:1"]; r.Value != "1" || r.ExpireAt != 5000 {
+		t.Errorf("Expected key:1 with its expiry, got %+v", r)
+	}
+	if _, ok := seen["key:2"]; ok {
+		t.Error("Expected expired key to be skipped")
+	}
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	if err := cache.Walk(func(Record) error { calls++; return stop }); err != stop || calls != 1 {
+		t.Errorf("Expected walk to stop at the first error, got %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,297 @@
+package lru
+
+import (
+	"container/list"
+	"hash/maphash"
+)
+
+// W-TinyLFU keeps new entries in a small LRU window and only admits them
+// into the main cache if a frequency sketch says they are requested more
+// often than the entry they would displace. The main cache is a segmented
+// LRU: entries start in probation and are promoted to the protected segment
+// when accessed again. A scan of one-hit keys therefore churns only the
+// window instead of flushing the hot set.
+
+type segment uint8
+
+const (
+	segWindow segment = iota
+	segProbation
+	segProtected
+)
+
+const (
+	windowPercent    = 1  // share of the budget given to the window
+	protectedPercent = 80 // share of the main cache given to protected
+	sketchDepth      = 4
+	sketchMaxCount   = 15 // counters saturate at 4 bits, as in the paper
+	sketchMinWidth   = 64
+	sketchResetRatio = 10 // counters are halved after width*ratio increments
+)
+
+// tinyLFU holds the W-TinyLFU segments. Segment lists hold the entry's
+// element in Cache.order so victims can be handed back to Cache.evict.
+type tinyLFU struct {
+	sketch    *countMinSketch
+	window    *list.List
+	probation *list.List
+	protected *list.List
+
+	windowWeight    int64
+	probationWeight int64
+	protectedWeight int64
+}
+
+// newTinyLFU builds the segments for the cache's current contents. Existing
+// entries are placed in probation, most recently used first.
+func newTinyLFU(c *Cache) *tinyLFU {
+	t := &tinyLFU{
+		sketch:    newCountMinSketch(c.expectedItems()),
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+	}
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		t.push(c, elem, segProbation)
+	}
+	return t
+}
+
+// expectedItems estimates how many entries the sketch must track.
+func (c *Cache) expectedItems() int {
+	if c.capacity > 0 {
+		return c.capacity
+	}
+	return len(c.items)
+}
+
+// weight is what an entry costs against the budget: its size when the
+// cache is bounded by memory, otherwise one item.
+func (c *Cache) weight(e *entry) int64 {
+	if c.maxMemory > 0 {
+		return e.size()
+	}
+	return 1
+}
+
+// budget is the total weight the cache may hold.
+func (c *Cache) budget() int64 {
+	if c.maxMemory > 0 {
+		return c.maxMemory
+	}
+	return int64(c.capacity)
+}
+
+func (t *tinyLFU) windowTarget(c *Cache) int64 {
+	return c.budget() * windowPercent / 100
+}
+
+func (t *tinyLFU) protectedTarget(c *Cache) int64 {
+	return (c.budget() - t.windowTarget(c)) * protectedPercent / 100
+}
+
+func (t *tinyLFU) list(seg segment) *list.List {
+	switch seg {
+	case segWindow:
+		return t.window
+	case segProbation:
+		return t.probation
+	}
+	return t.protected
+}
+
+func (t *tinyLFU) addWeight(seg segment, w int64) {
+	switch seg {
+	case segWindow:
+		t.windowWeight += w
+	case segProbation:
+		t.probationWeight += w
+	default:
+		t.protectedWeight += w
+	}
+}
+
+// push places elem at the front of a segment.
+func (t *tinyLFU) push(c *Cache, elem *list.Element, seg segment) {
+	e := elem.Value.(*entry)
+	e.segment = seg
+	e.segElem = t.list(seg).PushFront(elem)
+	e.weight = c.weight(e)
+	t.addWeight(seg, e.weight)
+}
+
+// unlink removes e from its segment.
+func (t *tinyLFU) unlink(e *entry) {
+	t.list(e.segment).Remove(e.segElem)
+	t.addWeight(e.segment, -e.weight)
+	e.segElem = nil
+}
+
+// move transfers elem to the front of another segment.
+func (t *tinyLFU) move(c *Cache, elem *list.Element, seg segment) {
+	t.unlink(elem.Value.(*entry))
+	t.push(c, elem, seg)
+}
+
+// add records a newly inserted entry, which always enters the window.
+func (t *tinyLFU) add(c *Cache, elem *list.Element) {
+	for len(c.items) > t.sketch.width {
+		t.sketch.grow()
+	}
+	t.sketch.increment(elem.Value.(*entry).key)
+	t.push(c, elem, segWindow)
+}
+
+// access records a hit on elem, promoting probation entries to protected
+// and demoting the protected segment's oldest entries if it overflows.
+func (t *tinyLFU) access(c *Cache, elem *list.Element) {
+	e := elem.Value.(*entry)
+	t.sketch.increment(e.key)
+
+	switch e.segment {
+	case segWindow, segProtected:
+		t.list(e.segment).MoveToFront(e.segElem)
+	case segProbation:
+		t.move(c, elem, segProtected)
+		for t.protectedWeight > t.protectedTarget(c) && t.protected.Len() > 1 {
+			t.move(c, t.protected.Back().Value.(*list.Element), segProbation)
+		}
+	}
+}
+
+// reweigh updates the weight of an entry whose value changed size.
+func (t *tinyLFU) reweigh(c *Cache, e *entry) {
+	t.addWeight(e.segment, -e.weight)
+	e.weight = c.weight(e)
+	t.addWeight(e.segment, e.weight)
+}
+
+// rebalance moves entries that overflow the window into probation. It runs
+// once the cache is within its limits, so they are admitted freely.
+func (t *tinyLFU) rebalance(c *Cache) {
+	for t.windowWeight > t.windowTarget(c) && t.window.Len() > 1 {
+		t.move(c, t.window.Back().Value.(*list.Element), segProbation)
+	}
+}
+
+// victim chooses between the window's oldest entry and the main cache's
+// next victim, keeping whichever the sketch estimates is requested more
+// often. An admitted candidate moves into probation.
+func (t *tinyLFU) victim(c *Cache) *list.Element {
+	front := c.order.Front()
+
+	var candidate *list.Element
+	if t.windowWeight > t.windowTarget(c) && t.window.Len() > 0 {
+		candidate = t.window.Back().Value.(*list.Element)
+		if candidate == front {
+			candidate = nil
+		}
+	}
+
+	var victim *list.Element
+	for _, seg := range []*list.List{t.probation, t.protected} {
+		if back := seg.Back(); back != nil && back.Value.(*list.Element) != front {
+			victim = back.Value.(*list.Element)
+			break
+		}
+	}
+
+	switch {
+	case candidate != nil && victim != nil:
+		ck, vk := candidate.Value.(*entry).key, victim.Value.(*entry).key
+		if t.sketch.estimate(ck) > t.sketch.estimate(vk) {
+			t.move(c, candidate, segProbation)
+			c.stats.Admitted++
+			return victim
+		}
+		c.stats.Rejected++
+		return candidate
+	case victim != nil:
+		return victim
+	case candidate != nil:
+		return candidate
+	}
+	if back := t.window.Back(); back != nil && back.Value.(*list.Element) != front {
+		return back.Value.(*list.Element)
+	}
+	return nil
+}
+
+// countMinSketch estimates how often keys were requested using depth rows
+// of small saturating counters. Counters are periodically halved so the
+// estimate favours recent popularity.
+type countMinSketch struct {
+	seed      maphash.Seed
+	counters  []uint8 // sketchDepth rows of width counters
+	width     int
+	mask      uint64
+	additions int
+}
+
+func newCountMinSketch(items int) *countMinSketch {
+	width := sketchMinWidth
+	for width < items {
+		width *= 2
+	}
+	return &countMinSketch{
+		seed:     maphash.MakeSeed(),
+		counters: make([]uint8, sketchDepth*width),
+		width:    width,
+		mask:     uint64(width - 1),
+	}
+}
+
+// index returns the counter position for key in row i.
+func (s *countMinSketch) index(h uint64, i int) int {
+	h1, h2 := h, h>>32|h<<32
+	return i*s.width + int((h1+uint64(i)*h2)&s.mask)
+}
+
+func (s *countMinSketch) increment(key string) {
+	h := maphash.String(s.seed, key)
+	for i := 0; i < sketchDepth; i++ {
+		if idx := s.index(h, i); s.counters[idx] < sketchMaxCount {
+			s.counters[idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.width*sketchResetRatio {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	h := maphash.String(s.seed, key)
+	min := uint8(sketchMaxCount)
+	for i := 0; i < sketchDepth; i++ {
+		if v := s.counters[s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// grow doubles the width of every row. Counters are indexed by the low bits
+// of the hash, so a key's counter moves either to the same position or to
+// the one a width further on; copying each counter to both keeps every
+// estimate, and the frequency history survives the cache filling up.
+func (s *countMinSketch) grow() {
+	width := s.width * 2
+	counters := make([]uint8, sketchDepth*width)
+	for i := 0; i < sketchDepth; i++ {
+		row := s.counters[i*s.width : (i+1)*s.width]
+		copy(counters[i*width:], row)
+		copy(counters[i*width+s.width:], row)
+	}
+	s.counters = counters
+	s.width = width
+	s.mask = uint64(width - 1)
+}
+
+// reset halves every counter.
+func (s *countMinSketch) reset() {
+	for i := range s.counters {
+		s.counters[i] /= 2
+	}
+	s.additions /= 2
+}
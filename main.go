@@ -4,22 +4,137 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"zencache/aof"
+	"zencache/lru"
+	"zencache/rdb"
 	"zencache/server"
 )
 
 func main() {
 	port := flag.Int("port", 6379, "Port to listen on")
-	capacity := flag.Int("capacity", 10000, "Maximum number of items in cache (LRU eviction)")
+	capacity := flag.Int("capacity", 10000, "Maximum number of items in cache (LRU eviction), 0 for unlimited")
+	maxmemory := flag.String("maxmemory", "0", "Maximum memory for cached data, e.g. 256mb (0 for unlimited)")
+	policy := flag.String("maxmemory-policy", "allkeys-lru", "Eviction policy: allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random, volatile-ttl, noeviction or allkeys-wtinylfu")
+	shards := flag.Int("shards", 16, "Number of independently locked cache shards")
+	dir := flag.String("dir", ".", "Directory of the snapshot and of a relative append-only file")
+	dbfilename := flag.String("dbfilename", "zencache.rdb", "File name of the snapshot inside -dir")
+	snapshotHistory := flag.Int("snapshot-history", 0, "Number of timestamped copies of past snapshots to keep (0 for none)")
+	appendonly := flag.Bool("appendonly", false, "Log every write to an append-only file and replay it on startup")
+	appendfilename := flag.String("appendfilename", "appendonly.aof", "Path of the append-only file")
+	appendfsync := flag.String("appendfsync", "everysec", "When to fsync the append-only file: always, everysec or no")
+	rewritePercentage := flag.Int("auto-aof-rewrite-percentage", 100, "Rewrite the append-only file once it grows by this percentage (0 disables)")
+	save := flag.String("save", "3600 1 300 100 60 10000", "Snapshot rules as \"seconds changes\" pairs; empty disables automatic and shutdown snapshots")
+	rewriteMinSize := flag.String("auto-aof-rewrite-min-size", "64mb", "Minimum append-only file size before it is rewritten automatically")
+	rdbFormat := flag.String("rdb-format", "zencache", "Format snapshots are written in: zencache or redis (both are loaded)")
+	rdbCompression := flag.Int("rdb-compression-level", 0, "Flate level from 1 (fastest) to 9 (smallest) for compressing snapshots, 0 for none")
+	replicaReadOnly := flag.Bool("replica-read-only", true, "Refuse writes from clients while this node is a replica")
+	backlogSize := flag.String("repl-backlog-size", "1mb", "Bytes of recent writes kept for replicas that reconnect")
+	outputBufferLimit := flag.String("replica-output-buffer-limit", "256mb", "Disconnect a replica once this much of the replication stream is queued for it (0 for no limit)")
+	importRDB := flag.String("import-rdb", "", "Load the keys of this snapshot, e.g. a Redis dump.rdb, on startup")
 	flag.Parse()
 
+	cfg := server.DefaultConfig(*port)
+	cfg.Capacity = *capacity
+	cfg.Shards = *shards
+	if *dbfilename == "" || filepath.Base(*dbfilename) != *dbfilename {
+		log.Fatal("dbfilename can't be a path, just a filename")
+	}
+	cfg.Dir = *dir
+	cfg.DBFilename = *dbfilename
+	cfg.SnapshotHistory = *snapshotHistory
+	cfg.AppendOnly = *appendonly
+	cfg.AppendFilename = *appendfilename
+	cfg.AutoAOFRewritePercentage = *rewritePercentage
+	cfg.RDBCompression = *rdbCompression
+	cfg.ImportRDB = *importRDB
+	cfg.ReplicaReadOnly = *replicaReadOnly
+
+	var err error
+	cfg.MaxMemory, err = server.ParseMemory(*maxmemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.MaxMemoryPolicy, err = lru.ParsePolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.AppendFsync, err = aof.ParseFsyncPolicy(*appendfsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.AutoAOFRewriteMinSize, err = server.ParseMemory(*rewriteMinSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Save, err = server.ParseSaveRules(*save)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.RDBFormat, err = rdb.ParseFormat(*rdbFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.ReplBacklogSize, err = server.ParseMemory(*backlogSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.ReplicaOutputBufferLimit, err = server.ParseMemory(*outputBufferLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// A memory limit replaces the default item limit unless both are given.
+	if cfg.MaxMemory > 0 && !flagSet("capacity") {
+		cfg.Capacity = 0
+	}
+
 	fmt.Printf("ZenCache v1.0\n")
-	fmt.Printf("  Port: %d\n", *port)
-	fmt.Printf("  Capacity: %d items\n", *capacity)
-	fmt.Println("  Commands: SET, GET, DEL, PING, SUBSCRIBE, PUBLISH, SAVE, REPLICAOF, INFO, QUIT")
+	fmt.Printf("  Port: %d\n", cfg.Port)
+	if cfg.Capacity > 0 {
+		fmt.Printf("  Capacity: %d items\n", cfg.Capacity)
+	}
+	if cfg.MaxMemory > 0 {
+		fmt.Printf("  Max memory: %d bytes\n", cfg.MaxMemory)
+	}
+	fmt.Printf("  Eviction policy: %s\n", cfg.MaxMemoryPolicy)
+	fmt.Printf("  Snapshot: %s\n", filepath.Join(cfg.Dir, cfg.DBFilename))
+	if cfg.AppendOnly {
+		fmt.Printf("  Append only file: %s (fsync %s)\n", cfg.AppendFilename, cfg.AppendFsync)
+	}
+	fmt.Println("  Commands: SET, GET, DEL, EXPIRE, TTL, PERSIST, PING, HELLO, SUBSCRIBE, PUBLISH, SAVE, BGSAVE, LASTSAVE, BGREWRITEAOF, DEBUG RELOAD, REPLICAOF, PSYNC, WAIT, CONFIG, INFO, SHUTDOWN, QUIT")
 	fmt.Println("Starting server...")
 
-	srv := server.NewServerWithCapacity(*port, *capacity)
+	srv := server.NewServerWithConfig(cfg)
+
+	// Stop gracefully on Ctrl-C or SIGTERM so the final snapshot is written.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			fmt.Printf("Received %v, shutting down...\n", sig)
+			if err := srv.Shutdown(); err != nil {
+				log.Printf("Error trying to shut down the server: %v", err)
+			}
+		}
+	}()
+
 	if err := srv.Start(); err != nil {
 		log.Fatal(err)
 	}
+	fmt.Println("ZenCache is now ready to exit, bye bye...")
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
@@ -0,0 +1,104 @@
+package rdb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyLayout timestamps snapshot copies in UTC. Names sort in the order
+// the copies were taken.
+const historyLayout = "20060102-150405.000"
+
+// Rotate keeps a timestamped copy of the current snapshot next to it, named
+// like zencache-20240131-235959.000.rdb for zencache.rdb, then deletes all
+// but the newest keep copies. Copies are hard links where the filesystem
+// allows, so a copy takes no extra space until the snapshot is replaced.
+func (r *RDB) Rotate(keep int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := r.FilePath()
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext) + "-" + time.Now().UTC().Format(historyLayout) + ext
+	if err := os.Link(path, filepath.Join(dir, name)); err != nil {
+		if err := copyFile(path, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	history, err := r.History()
+	if err != nil {
+		return err
+	}
+	for len(history) > keep {
+		if err := os.Remove(history[0]); err != nil {
+			return err
+		}
+		history = history[1:]
+	}
+	return nil
+}
+
+// History returns the paths of the timestamped copies kept by Rotate,
+// oldest first. Any of them can be loaded like the snapshot itself.
+func (r *RDB) History() ([]string, error) {
+	path := r.FilePath()
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var history []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(historyLayout, stamp); err == nil {
+			history = append(history, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(history)
+	return history, nil
+}
+
+// copyFile copies src to dst through a temporary file, so dst is either
+// complete or absent.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -1,57 +1,454 @@
 package rdb
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"zencache/lru"
 )
 
+// A snapshot file starts with magic followed by a four digit format
+// version, and ends with a little-endian CRC64 (ECMA) of everything before
+// it. Files without the header predate it and are read as a bare gob stream.
+//
+// Version 3 follows the header with a byte naming the compression of the
+// rest of the body, compressNone or compressFlate. The body holds one
+// record per key:
+//
+//	type       1 byte, typeString
+//	key        uvarint length, bytes
+//	value      uvarint length, bytes
+//	expireAt   varint Unix milliseconds, 0 for no expiry
+//	accessedAt varint Unix milliseconds of the last access
+//	freq       1 byte LFU counter
+//
+// followed by opEOF.
+const (
+	magic      = "ZENCACHE"
+	version    = 3
+	headerSize = len(magic) + 4
+	crcSize    = 8
+
+	maxStringLen = 512 << 20 // matches Redis's largest bulk string
+)
+
+// Record types. ZenCache only stores strings today; the type byte leaves
+// room for more.
+const (
+	typeString byte = 0x00
+	opEOF      byte = 0xff
+)
+
+// Body compression methods.
+const (
+	compressNone  byte = 0x00
+	compressFlate byte = 0x01
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// ErrCorrupt is wrapped by errors describing a damaged snapshot file.
+var ErrCorrupt = errors.New("corrupt RDB file")
+
+// Format selects the file format snapshots are written in. Either format
+// is recognised when loading.
+type Format int
+
+const (
+	FormatZenCache Format = iota // the native format described above
+	FormatRedis                  // the RDB format of Redis, see redis.go
+)
+
+var formatNames = []string{
+	FormatZenCache: "zencache",
+	FormatRedis:    "redis",
+}
+
+// String returns the format's configuration name.
+func (f Format) String() string {
+	if f >= 0 && int(f) < len(formatNames) {
+		return formatNames[f]
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat converts "zencache" or "redis" to a Format.
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if n == strings.ToLower(name) {
+			return Format(f), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid RDB format '%s'", name)
+}
+
+// LoadResult describes a loaded snapshot.
+type LoadResult struct {
+	Loaded  int // records accepted by restore
+	Skipped int // Redis keys of unsupported types or outside database 0
+}
+
 // RDB handles persistence using binary snapshots.
 type RDB struct {
-	mu       sync.Mutex
-	filepath string
+	mu          sync.Mutex             // serialises saves and loads
+	filepath    atomic.Pointer[string] // readable while a save runs
+	format      atomic.Int32           // a Format, readable while a save runs
+	compression atomic.Int32           // flate level of native snapshots, 0 for none
 }
 
 // NewRDB creates a new RDB instance.
 func NewRDB(filepath string) *RDB {
-	return &RDB{
-		filepath: filepath,
+	r := &RDB{}
+	r.filepath.Store(&filepath)
+	return r
+}
+
+// SetFilePath changes where future snapshots are written and loaded from.
+// A save in progress finishes at the old path.
+func (r *RDB) SetFilePath(path string) {
+	r.filepath.Store(&path)
+}
+
+// SetFormat selects the format of future snapshots.
+func (r *RDB) SetFormat(f Format) {
+	r.format.Store(int32(f))
+}
+
+// Format returns the format snapshots are written in.
+func (r *RDB) Format() Format {
+	return Format(r.format.Load())
+}
+
+// SetCompression sets the flate compression level of future native
+// snapshots, from 1 (fastest) to 9 (smallest). Level 0 disables compression.
+func (r *RDB) SetCompression(level int) error {
+	if level < 0 || level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d, expected 0 to %d", level, flate.BestCompression)
 	}
+	r.compression.Store(int32(level))
+	return nil
+}
+
+// Compression returns the compression level of native snapshots.
+func (r *RDB) Compression() int {
+	return int(r.compression.Load())
 }
 
 // Save writes the current data to disk.
 func (r *RDB) Save(data map[string]string) error {
+	return r.SaveRecords(func(fn func(lru.Record) error) error {
+		for k, v := range data {
+			if err := fn(lru.Record{Key: k, Value: v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveRecords writes the records produced by walk to disk as they arrive,
+// so the dataset is never copied in full. walk has the signature of
+// lru.Sharded.Walk.
+//
+// The snapshot is written to a temporary file in the same directory,
+// synced and renamed over the old one, so a crash leaves either the old or
+// the new snapshot intact.
+func (r *RDB) SaveRecords(walk func(fn func(lru.Record) error) error) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	file, err := os.Create(r.filepath)
+	path := r.FilePath()
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "temp-*.rdb")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
 
-	encoder := gob.NewEncoder(file)
-	return encoder.Encode(data)
+	if r.Format() == FormatRedis {
+		err = WriteRedis(tmp, walk)
+	} else {
+		err = WriteSnapshot(tmp, walk, r.Compression())
+	}
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	renamed = true
+	syncDir(dir)
+	return nil
 }
 
-// Load reads data from disk.
+// WriteSnapshot writes a native snapshot of the records produced by walk to
+// w: the header, the records, compressed at the given flate level unless it
+// is 0, and the checksum trailer. Records are encoded as walk produces them.
+func WriteSnapshot(file io.Writer, walk func(fn func(lru.Record) error) error, level int) error {
+	w := bufio.NewWriter(file)
+	crc := crc64.New(crcTable)
+	out := io.MultiWriter(w, crc)
+
+	method := compressNone
+	if level > 0 {
+		method = compressFlate
+	}
+	if _, err := fmt.Fprintf(out, "%s%04d%c", magic, version, method); err != nil {
+		return err
+	}
+	var compressor *flate.Writer
+	if method == compressFlate {
+		var err error
+		if compressor, err = flate.NewWriter(out, level); err != nil {
+			return err
+		}
+		out = compressor
+	}
+	body := bufio.NewWriter(out)
+
+	var buf [binary.MaxVarintLen64]byte
+	putString := func(s string) {
+		body.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+		body.WriteString(s)
+	}
+	err := walk(func(rec lru.Record) error {
+		body.WriteByte(typeString)
+		putString(rec.Key)
+		putString(rec.Value)
+		body.Write(buf[:binary.PutVarint(buf[:], rec.ExpireAt)])
+		body.Write(buf[:binary.PutVarint(buf[:], rec.AccessedAt)])
+		return body.WriteByte(rec.Freq)
+	})
+	if err != nil {
+		return err
+	}
+	body.WriteByte(opEOF)
+	if err := body.Flush(); err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, crc.Sum64()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// syncDir makes a rename in dir durable. It is best effort: not every
+// platform can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Load reads data from disk. It fails with an error wrapping ErrCorrupt if
+// the file is truncated, fails its checksum or cannot be decoded, rather
+// than returning partial data.
 func (r *RDB) Load() (map[string]string, error) {
+	data := make(map[string]string)
+	_, err := r.LoadRecords(func(rec lru.Record) bool {
+		data[rec.Key] = rec.Value
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// LoadRecords streams every record in the snapshot to restore, which has
+// the signature of lru.Sharded.Restore. The format is detected from the
+// file's header. The checksum of a native snapshot is verified before any
+// record is delivered, so a damaged file yields an error wrapping
+// ErrCorrupt and no records; a Redis file's checksum is only checked at its
+// end. Records from formats without metadata have a zero AccessedAt.
+func (r *RDB) LoadRecords(restore func(lru.Record) bool) (LoadResult, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	file, err := os.Open(r.filepath)
+	file, err := os.Open(r.FilePath())
 	if err != nil {
-		return nil, err
+		return LoadResult{}, err
 	}
 	defer file.Close()
 
+	br := bufio.NewReader(file)
+	if prefix, _ := br.Peek(len(redisMagic)); string(prefix) == redisMagic {
+		return ReadRedis(br, restore)
+	}
+	header, err := br.Peek(headerSize)
+	if err != nil || !bytes.HasPrefix(header, []byte(magic)) {
+		// A snapshot written before the header was introduced.
+		return decodeGob(br, restore)
+	}
+	v, err := strconv.Atoi(string(header[len(magic):]))
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("%w: bad version %q", ErrCorrupt, header[len(magic):])
+	}
+	if v != version {
+		return LoadResult{}, fmt.Errorf("unsupported RDB format version %d", v)
+	}
+
+	size, err := verifyChecksum(file)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	if _, err := file.Seek(int64(headerSize), io.SeekStart); err != nil {
+		return LoadResult{}, err
+	}
+	body := bufio.NewReader(io.LimitReader(file, size-int64(headerSize)-crcSize))
+	method, err := body.ReadByte()
+	if err != nil {
+		return LoadResult{}, fmt.Errorf("%w: %v", ErrCorrupt, io.ErrUnexpectedEOF)
+	}
+	switch method {
+	case compressNone:
+		return decodeRecords(body, restore)
+	case compressFlate:
+		decompressor := flate.NewReader(body)
+		defer decompressor.Close()
+		return decodeRecords(bufio.NewReader(decompressor), restore)
+	}
+	return LoadResult{}, fmt.Errorf("%w: unknown compression method 0x%02x", ErrCorrupt, method)
+}
+
+// verifyChecksum checks the CRC64 trailer and returns the file size.
+func verifyChecksum(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size < int64(headerSize+crcSize) {
+		return 0, fmt.Errorf("%w: file is truncated", ErrCorrupt)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	crc := crc64.New(crcTable)
+	if _, err := io.CopyN(crc, file, size-crcSize); err != nil {
+		return 0, err
+	}
+	var sum uint64
+	if err := binary.Read(file, binary.LittleEndian, &sum); err != nil {
+		return 0, err
+	}
+	if sum != crc.Sum64() {
+		return 0, fmt.Errorf("%w: checksum mismatch (expected %016x, got %016x)", ErrCorrupt, sum, crc.Sum64())
+	}
+	return size, nil
+}
+
+// decodeRecords reads records up to opEOF.
+func decodeRecords(r *bufio.Reader, restore func(lru.Record) bool) (LoadResult, error) {
+	corrupt := func(err error) (LoadResult, error) {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return LoadResult{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if n > maxStringLen {
+			return "", fmt.Errorf("string length %d too large", n)
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+
+	var res LoadResult
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return corrupt(err)
+		}
+		if typ == opEOF {
+			if _, err := r.ReadByte(); err != io.EOF {
+				return corrupt(errors.New("data after end of snapshot"))
+			}
+			return res, nil
+		}
+		if typ != typeString {
+			return corrupt(fmt.Errorf("unknown value type 0x%02x", typ))
+		}
+
+		var rec lru.Record
+		if rec.Key, err = readString(); err != nil {
+			return corrupt(err)
+		}
+		if rec.Value, err = readString(); err != nil {
+			return corrupt(err)
+		}
+		if rec.ExpireAt, err = binary.ReadVarint(r); err != nil {
+			return corrupt(err)
+		}
+		if rec.AccessedAt, err = binary.ReadVarint(r); err != nil {
+			return corrupt(err)
+		}
+		if rec.Freq, err = r.ReadByte(); err != nil {
+			return corrupt(err)
+		}
+		if restore(rec) {
+			res.Loaded++
+		}
+	}
+}
+
+// decodeGob reads the single gob encoded map written by snapshots without
+// a header.
+func decodeGob(r io.Reader, restore func(lru.Record) bool) (LoadResult, error) {
 	var data map[string]string
-	decoder := gob.NewDecoder(file)
-	err = decoder.Decode(&data)
-	return data, err
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return LoadResult{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	var res LoadResult
+	for k, v := range data {
+		if restore(lru.Record{Key: k, Value: v}) {
+			res.Loaded++
+		}
+	}
+	return res, nil
 }
 
 // FilePath returns the RDB file path.
 func (r *RDB) FilePath() string {
-	return r.filepath
+	return *r.filepath.Load()
 }
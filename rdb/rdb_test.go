@@ -1,8 +1,16 @@
 package rdb
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"zencache/lru"
 )
 
 func TestSaveAndLoad(t *testing.T) {
@@ -46,3 +54,222 @@ func TestLoadNonexistent(t *testing.T) {
 		t.Error("Expected error loading nonexistent file")
 	}
 }
+
+func TestSaveRecordsWithMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	r := NewRDB(path)
+
+	n := 5000
+	walk := func(fn func(lru.Record) error) error {
+		for i := 0; i < n; i++ {
+			rec := lru.Record{
+				Key:        fmt.Sprintf("key:%d", i),
+				Value:      fmt.Sprintf("%d", i),
+				AccessedAt: int64(1000 + i),
+				Freq:       uint8(i % 256),
+			}
+			if i%2 == 0 {
+				rec.ExpireAt = 1 << 50
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := r.SaveRecords(walk); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	var loaded []lru.Record
+	res, err := r.LoadRecords(func(rec lru.Record) bool {
+		loaded = append(loaded, rec)
+		return rec.ExpireAt == 0
+	})
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if len(loaded) != n || res.Loaded != n/2 {
+		t.Fatalf("Expected %d records with %d accepted, got %d and %d", n, n/2, len(loaded), res.Loaded)
+	}
+	expected := lru.Record{Key: "key:3000", Value: "3000", ExpireAt: 1 << 50, AccessedAt: 4000, Freq: 3000 % 256}
+	if loaded[3000] != expected {
+		t.Errorf("Expected %+v in save order, got %+v", expected, loaded[3000])
+	}
+}
+
+func TestSaveRecordsWalkError(t *testing.T) {
+	filepath := "test_rdb_error.gob"
+	defer os.Remove(filepath)
+
+	walkErr := errors.New("walk failed")
+	err := NewRDB(filepath).SaveRecords(func(fn func(lru.Record) error) error {
+		return walkErr
+	})
+	if err != walkErr {
+		t.Errorf("Expected the walk error, got %v", err)
+	}
+}
+
+func TestLoadDetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	r := NewRDB(path)
+	if err := r.Save(map[string]string{"key1": "value1", "key2": "value2"}); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	good, _ := os.ReadFile(path)
+	if string(good[:headerSize]) != "ZENCACHE0003" {
+		t.Errorf("Expected versioned header, got %q", good[:headerSize])
+	}
+
+	cases := map[string][]byte{
+		"flipped byte": func() []byte {
+			b := bytes.Clone(good)
+			b[len(b)/2] ^= 0xff
+			return b
+		}(),
+		"truncated":     good[:len(good)-3],
+		"header only":   good[:headerSize],
+		"bad checksum":  append(bytes.Clone(good[:len(good)-1]), good[len(good)-1]+1),
+		"trailing data": append(bytes.Clone(good), 0),
+	}
+	for name, data := range cases {
+		os.WriteFile(path, data, 0644)
+		if _, err := r.Load(); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+	}
+
+	os.WriteFile(path, append([]byte("ZENCACHE0099"), good[headerSize:]...), 0644)
+	if _, err := r.Load(); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Expected unsupported version error, got %v", err)
+	}
+}
+
+func TestLoadLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(map[string]string{"key1": "value1"})
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	var records []lru.Record
+	if _, err := NewRDB(path).LoadRecords(func(rec lru.Record) bool {
+		records = append(records, rec)
+		return true
+	}); err != nil || len(records) != 1 || records[0] != (lru.Record{Key: "key1", Value: "value1"}) {
+		t.Errorf("Expected headerless snapshot to load without metadata, got %+v, %v", records, err)
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	r := NewRDB(path)
+
+	n := 20000
+	walk := func(fn func(lru.Record) error) error {
+		for i := 0; i < n; i++ {
+			rec := lru.Record{Key: fmt.Sprintf("user:%d", i), Value: strings.Repeat("session", 10), AccessedAt: int64(i)}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sizes := map[int]int64{}
+	for _, level := range []int{0, 1, 9} {
+		if err := r.SetCompression(level); err != nil {
+			t.Fatalf("Failed to set level %d: %v", level, err)
+		}
+		if err := r.SaveRecords(walk); err != nil {
+			t.Fatalf("Failed to save at level %d: %v", level, err)
+		}
+		info, _ := os.Stat(path)
+		sizes[level] = info.Size()
+
+		count := 0
+		res, err := r.LoadRecords(func(rec lru.Record) bool {
+			if rec.Key != fmt.Sprintf("user:%d", count) || rec.AccessedAt != int64(count) {
+				t.Fatalf("Level %d: unexpected record %d: %+v", level, count, rec)
+			}
+			count++
+			return true
+		})
+		if err != nil || res.Loaded != n {
+			t.Fatalf("Level %d: expected %d records, got %d, %v", level, n, res.Loaded, err)
+		}
+	}
+	if sizes[1] >= sizes[0]/4 || sizes[9] > sizes[1] {
+		t.Errorf("Expected compression to shrink the snapshot, got sizes %v", sizes)
+	}
+
+	// Damage inside the compressed body is caught by the checksum.
+	good, _ := os.ReadFile(path)
+	bad := bytes.Clone(good)
+	bad[len(bad)/2] ^= 0xff
+	os.WriteFile(path, bad, 0644)
+	if _, err := r.Load(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt, got %v", err)
+	}
+
+	for _, level := range []int{-1, 10} {
+		if err := r.SetCompression(level); err == nil {
+			t.Errorf("Expected level %d to be rejected", level)
+		}
+	}
+}
+
+func TestFailedSaveKeepsSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+	r := NewRDB(path)
+	if err := r.Save(map[string]string{"key1": "value1"}); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	err := r.SaveRecords(func(fn func(lru.Record) error) error {
+		fn(lru.Record{Key: "key2", Value: "value2"})
+		return errors.New("walk failed")
+	})
+	if err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+
+	data, err := r.Load()
+	if err != nil || len(data) != 1 || data["key1"] != "value1" {
+		t.Errorf("Expected the previous snapshot to survive, got %v, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the temporary file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRDB(filepath.Join(dir, "dump.rdb"))
+	os.WriteFile(filepath.Join(dir, "dump-notes.rdb"), []byte("unrelated"), 0644)
+
+	for i := 0; i < 4; i++ {
+		if err := r.Save(map[string]string{"generation": fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Failed to save: %v", err)
+		}
+		if err := r.Rotate(2); err != nil {
+			t.Fatalf("Failed to rotate: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	history, err := r.History()
+	if err != nil || len(history) != 2 {
+		t.Fatalf("Expected 2 copies, got %v, %v", history, err)
+	}
+	// Each copy keeps the data it was taken with after the snapshot moves on.
+	for i, path := range history {
+		data, err := NewRDB(path).Load()
+		if err != nil || data["generation"] != fmt.Sprint(i+2) {
+			t.Errorf("Expected %s to hold generation %d, got %v, %v", path, i+2, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump-notes.rdb")); err != nil {
+		t.Errorf("Expected unrelated files to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,702 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+	"time"
+	"zencache/lru"
+)
+
+// This file reads and writes the RDB format used by Redis, so existing
+// dump.rdb files can seed ZenCache and ZenCache snapshots can be fed to
+// Redis and its tooling. Only string keys map onto ZenCache; values of other
+// types, including streams, module values and hashes with field expiry, are
+// skipped when reading. Module values written before Redis 4.0 and function
+// libraries from before Redis 7.0 cannot be told apart from what follows
+// them, so files containing them are refused.
+
+const (
+	redisMagic = "REDIS"
+	// redisVersion is the format version written. Version 9 (Redis 5.0)
+	// added the LRU and LFU opcodes and is readable by every later release.
+	redisVersion = 9
+	// redisMaxVersion is the newest format version that can be read.
+	redisMaxVersion = 12
+)
+
+// Opcodes from Redis's rdb.h.
+const (
+	rdbOpSlotInfo  = 0xf4
+	rdbOpFunction2 = 0xf5
+	rdbOpFunction  = 0xf6
+	rdbOpModuleAux = 0xf7
+	rdbOpIdle      = 0xf8
+	rdbOpFreq      = 0xf9
+	rdbOpAux       = 0xfa
+	rdbOpResizeDB  = 0xfb
+	rdbOpExpireMs  = 0xfc
+	rdbOpExpireSec = 0xfd
+	rdbOpSelectDB  = 0xfe
+	rdbOpEOF       = 0xff
+)
+
+// Value types from Redis's rdb.h.
+const (
+	rdbTypeString              = 0
+	rdbTypeList                = 1
+	rdbTypeSet                 = 2
+	rdbTypeZSet                = 3
+	rdbTypeHash                = 4
+	rdbTypeZSet2               = 5
+	rdbTypeModulePreGA         = 6
+	rdbTypeModule2             = 7
+	rdbTypeHashZipmap          = 9
+	rdbTypeListZiplist         = 10
+	rdbTypeSetIntset           = 11
+	rdbTypeZSetZiplist         = 12
+	rdbTypeHashZiplist         = 13
+	rdbTypeListQuicklist       = 14
+	rdbTypeStreamListpacks     = 15
+	rdbTypeHashListpack        = 16
+	rdbTypeZSetListpack        = 17
+	rdbTypeListQuicklist2      = 18
+	rdbTypeStreamListpacks2    = 19
+	rdbTypeSetListpack         = 20
+	rdbTypeStreamListpacks3    = 21
+	rdbTypeHashMetadataPreGA   = 22
+	rdbTypeHashListpackExPreGA = 23
+	rdbTypeHashMetadata        = 24
+	rdbTypeHashListpackEx      = 25
+)
+
+// Field opcodes of module values, which are stored as a sequence of typed
+// fields so they can be skipped without the module.
+const (
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSInt   = 1
+	rdbModuleOpUInt   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+)
+
+// Length encodings. The top two bits of the first byte select the form;
+// rdbLenEncoded marks a specially encoded string instead of a length.
+const (
+	rdbLen6Bit    = 0
+	rdbLen14Bit   = 1
+	rdbLenEncoded = 3
+	rdbLen32Bit   = 0x80
+	rdbLen64Bit   = 0x81
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// jonesTable drives the CRC64 variant Redis uses: the Jones polynomial,
+// reflected, with no initial or final inversion.
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// jonesCRC accumulates Redis's CRC64.
+type jonesCRC struct {
+	crc uint64
+}
+
+func (j *jonesCRC) Write(p []byte) (int, error) {
+	// crc64.Update inverts the value on entry and exit; undo both.
+	j.crc = ^crc64.Update(^j.crc, jonesTable, p)
+	return len(p), nil
+}
+
+func (j *jonesCRC) WriteByte(b byte) error {
+	j.crc = jonesTable[byte(j.crc)^b] ^ j.crc>>8
+	return nil
+}
+
+func (j *jonesCRC) Sum64() uint64 { return j.crc }
+
+// checksummedReader hashes exactly the bytes its caller consumes, unlike
+// a TeeReader beneath a bufio.Reader, which would also hash read-ahead.
+type checksummedReader struct {
+	r   *bufio.Reader
+	crc jonesCRC
+}
+
+func (c *checksummedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *checksummedReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.WriteByte(b)
+	}
+	return b, err
+}
+
+// WriteRedis writes the records produced by walk as a Redis RDB file with
+// a single database 0. Every key carries its expiry and both its idle time
+// and LFU counter, so Redis restores whichever its eviction policy uses.
+func WriteRedis(w io.Writer, walk func(fn func(lru.Record) error) error) error {
+	bw := bufio.NewWriter(w)
+	crc := &jonesCRC{}
+	e := &redisEncoder{w: bufio.NewWriter(io.MultiWriter(bw, crc))}
+
+	fmt.Fprintf(e.w, "%s%04d", redisMagic, redisVersion)
+	e.aux("redis-bits", "64")
+	e.aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	e.w.WriteByte(rdbOpSelectDB)
+	e.length(0)
+
+	nowMs := time.Now().UnixMilli()
+	err := walk(func(rec lru.Record) error {
+		if rec.ExpireAt != 0 {
+			e.w.WriteByte(rdbOpExpireMs)
+			binary.Write(e.w, binary.LittleEndian, rec.ExpireAt)
+		}
+		if rec.AccessedAt != 0 {
+			idle := (nowMs - rec.AccessedAt) / 1000
+			e.w.WriteByte(rdbOpIdle)
+			e.length(uint64(max(idle, 0)))
+			e.w.WriteByte(rdbOpFreq)
+			e.w.WriteByte(rec.Freq)
+		}
+		e.w.WriteByte(rdbTypeString)
+		e.string(rec.Key)
+		e.string(rec.Value)
+		return e.err()
+	})
+	if err != nil {
+		return err
+	}
+	e.w.WriteByte(rdbOpEOF)
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, crc.Sum64()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type redisEncoder struct {
+	w *bufio.Writer
+}
+
+// err reports a pending write error. bufio.Writer keeps the first one, so
+// the individual writes above need not be checked.
+func (e *redisEncoder) err() error {
+	_, err := e.w.Write(nil)
+	return err
+}
+
+func (e *redisEncoder) length(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.w.WriteByte(byte(n))
+	case n < 1<<14:
+		e.w.WriteByte(byte(n>>8) | rdbLen14Bit<<6)
+		e.w.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		e.w.WriteByte(rdbLen32Bit)
+		binary.Write(e.w, binary.BigEndian, uint32(n))
+	default:
+		e.w.WriteByte(rdbLen64Bit)
+		binary.Write(e.w, binary.BigEndian, n)
+	}
+}
+
+func (e *redisEncoder) string(s string) {
+	e.length(uint64(len(s)))
+	e.w.WriteString(s)
+}
+
+func (e *redisEncoder) aux(key, value string) {
+	e.w.WriteByte(rdbOpAux)
+	e.string(key)
+	e.string(value)
+}
+
+// ReadRedis reads a Redis RDB file, passing string keys in database 0 to
+// restore, which has the signature of lru.Sharded.Restore. Keys that had
+// already expired are still passed on; restore decides what to keep.
+// Errors describing a malformed file wrap ErrCorrupt.
+func ReadRedis(r io.Reader, restore func(lru.Record) bool) (LoadResult, error) {
+	var res LoadResult
+	d := &redisDecoder{r: &checksummedReader{r: bufio.NewReader(r)}}
+
+	header := make([]byte, len(redisMagic)+4)
+	if _, err := io.ReadFull(d.r, header); err != nil || string(header[:len(redisMagic)]) != redisMagic {
+		return res, fmt.Errorf("%w: not a Redis RDB file", ErrCorrupt)
+	}
+	v, err := strconv.Atoi(string(header[len(redisMagic):]))
+	if err != nil {
+		return res, fmt.Errorf("%w: bad version %q", ErrCorrupt, header[len(redisMagic):])
+	}
+	if v < 1 || v > redisMaxVersion {
+		return res, fmt.Errorf("unsupported Redis RDB format version %d", v)
+	}
+
+	nowMs := time.Now().UnixMilli()
+	db := uint64(0)
+	var rec lru.Record
+	for {
+		typ, err := d.r.ReadByte()
+		if err != nil {
+			return res, d.corrupt(err)
+		}
+		switch typ {
+		case rdbOpEOF:
+			if v < 5 {
+				return res, nil // checksums were added in version 5
+			}
+			// The checksum covers everything up to and including EOF.
+			sum := d.r.crc.Sum64()
+			var expected uint64
+			if err := binary.Read(d.r, binary.LittleEndian, &expected); err != nil {
+				return res, d.corrupt(err)
+			}
+			// A zero checksum means Redis ran with rdbchecksum no.
+			if expected != 0 && expected != sum {
+				return res, fmt.Errorf("%w: checksum mismatch (expected %016x, got %016x)", ErrCorrupt, expected, sum)
+			}
+			return res, nil
+
+		case rdbOpSelectDB:
+			if db, err = d.length(); err != nil {
+				return res, d.corrupt(err)
+			}
+		case rdbOpResizeDB:
+			if _, err = d.length(); err == nil {
+				_, err = d.length()
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = d.length()
+			}
+		case rdbOpAux:
+			if _, err = d.string(); err == nil {
+				_, err = d.string()
+			}
+		case rdbOpFunction2:
+			_, err = d.string()
+		case rdbOpModuleAux:
+			// Module ID, then when the data was saved as an opcode and
+			// value pair.
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = d.length()
+			}
+			if err == nil {
+				err = d.skipModuleValue()
+			}
+		case rdbOpFunction:
+			return res, fmt.Errorf("unsupported Redis RDB opcode 0x%02x (functions from before Redis 7.0)", typ)
+		case rdbOpExpireMs:
+			err = binary.Read(d.r, binary.LittleEndian, &rec.ExpireAt)
+		case rdbOpExpireSec:
+			var sec int32
+			err = binary.Read(d.r, binary.LittleEndian, &sec)
+			rec.ExpireAt = int64(sec) * 1000
+		case rdbOpIdle:
+			var idle uint64
+			idle, err = d.length()
+			rec.AccessedAt = nowMs - int64(idle)*1000
+		case rdbOpFreq:
+			rec.Freq, err = d.r.ReadByte()
+			if rec.AccessedAt == 0 {
+				rec.AccessedAt = nowMs
+			}
+
+		default:
+			// A key-value pair of the given type.
+			if rec.Key, err = d.string(); err != nil {
+				return res, d.corrupt(err)
+			}
+			if typ == rdbTypeString && db == 0 {
+				if rec.Value, err = d.string(); err != nil {
+					return res, d.corrupt(err)
+				}
+				if restore(rec) {
+					res.Loaded++
+				}
+			} else {
+				if err := d.skipValue(typ); err != nil {
+					return res, err
+				}
+				res.Skipped++
+			}
+			rec = lru.Record{}
+		}
+		if err != nil {
+			return res, d.corrupt(err)
+		}
+	}
+}
+
+type redisDecoder struct {
+	r *checksummedReader
+}
+
+func (d *redisDecoder) corrupt(err error) error {
+	if err == nil || errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+// rawLength reads a length, reporting whether it is instead the marker of
+// a specially encoded string, in which case n is the encoding.
+func (d *redisDecoder) rawLength() (n uint64, encoded bool, err error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbLen6Bit:
+		return uint64(b & 0x3f), false, nil
+	case rdbLen14Bit:
+		next, err := d.r.ReadByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case rdbLenEncoded:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdbLen32Bit:
+		var n uint32
+		err := binary.Read(d.r, binary.BigEndian, &n)
+		return uint64(n), false, err
+	case rdbLen64Bit:
+		var n uint64
+		err := binary.Read(d.r, binary.BigEndian, &n)
+		return n, false, err
+	}
+	return 0, false, fmt.Errorf("%w: unknown length encoding 0x%02x", ErrCorrupt, b)
+}
+
+func (d *redisDecoder) length() (uint64, error) {
+	n, encoded, err := d.rawLength()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: unexpected encoded string", ErrCorrupt)
+	}
+	return n, err
+}
+
+// string reads a string, expanding integer and LZF encodings.
+func (d *redisDecoder) string() (string, error) {
+	n, encoded, err := d.rawLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		return d.bytes(n)
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := d.r.ReadByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		var v int16
+		err := binary.Read(d.r, binary.LittleEndian, &v)
+		return strconv.Itoa(int(v)), err
+	case rdbEncInt32:
+		var v int32
+		err := binary.Read(d.r, binary.LittleEndian, &v)
+		return strconv.Itoa(int(v)), err
+	case rdbEncLZF:
+		clen, err := d.length()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.length()
+		if err != nil {
+			return "", err
+		}
+		if clen > maxStringLen || ulen > maxStringLen {
+			return "", fmt.Errorf("%w: compressed string length %d or %d too large", ErrCorrupt, clen, ulen)
+		}
+		compressed, err := d.bytes(clen)
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress([]byte(compressed), int(ulen))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return string(out), nil
+	}
+	return "", fmt.Errorf("%w: unknown string encoding %d", ErrCorrupt, n)
+}
+
+func (d *redisDecoder) bytes(n uint64) (string, error) {
+	if n > maxStringLen {
+		return "", fmt.Errorf("%w: string length %d too large", ErrCorrupt, n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return string(b), err
+}
+
+// skipValue consumes a value that is not loaded.
+func (d *redisDecoder) skipValue(typ byte) error {
+	strings := func(perElem uint64) error {
+		n, err := d.length()
+		for i := uint64(0); i < n*perElem && err == nil; i++ {
+			_, err = d.string()
+		}
+		return err
+	}
+
+	var err error
+	switch typ {
+	case rdbTypeList, rdbTypeSet, rdbTypeListQuicklist:
+		err = strings(1)
+	case rdbTypeHash:
+		err = strings(2)
+	case rdbTypeZSet:
+		// Scores were stored as text before ZSET2.
+		var n uint64
+		n, err = d.length()
+		for i := uint64(0); i < n && err == nil; i++ {
+			if _, err = d.string(); err == nil {
+				err = d.skipTextDouble()
+			}
+		}
+	case rdbTypeZSet2:
+		var n uint64
+		n, err = d.length()
+		for i := uint64(0); i < n && err == nil; i++ {
+			if _, err = d.string(); err == nil {
+				_, err = io.ReadFull(d.r, make([]byte, 8)) // binary double score
+			}
+		}
+	case rdbTypeListQuicklist2:
+		var n uint64
+		n, err = d.length()
+		for i := uint64(0); i < n && err == nil; i++ {
+			if _, err = d.length(); err == nil { // container kind
+				_, err = d.string()
+			}
+		}
+	case rdbTypeHashMetadata, rdbTypeHashMetadataPreGA:
+		// Hashes with field expiry; the current form leads with the
+		// earliest expiry, and every field has its own.
+		if typ == rdbTypeHashMetadata {
+			err = d.skip(8)
+		}
+		var n uint64
+		if err == nil {
+			n, err = d.length()
+		}
+		for i := uint64(0); i < n && err == nil; i++ {
+			// Expiry, field and value.
+			if _, err = d.length(); err == nil {
+				if _, err = d.string(); err == nil {
+					_, err = d.string()
+				}
+			}
+		}
+	case rdbTypeHashListpackEx:
+		// The earliest field expiry, then the listpack.
+		if err = d.skip(8); err == nil {
+			_, err = d.string()
+		}
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		err = d.skipStream(typ)
+	case rdbTypeModule2:
+		if _, err = d.length(); err == nil { // module ID
+			err = d.skipModuleValue()
+		}
+	case rdbTypeModulePreGA:
+		return fmt.Errorf("unsupported Redis RDB value type %d (a module value from before Redis 4.0)", typ)
+	case rdbTypeString, rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack,
+		rdbTypeHashListpackExPreGA:
+		// Strings outside database 0, and compact encodings stored as a
+		// single blob.
+		_, err = d.string()
+	default:
+		return fmt.Errorf("unsupported Redis RDB value type %d", typ)
+	}
+	return d.corrupt(err)
+}
+
+// skip consumes n bytes.
+func (d *redisDecoder) skip(n int) error {
+	_, err := io.ReadFull(d.r, make([]byte, n))
+	return err
+}
+
+// skipTextDouble consumes a double stored as text, as sorted set scores
+// were before ZSET2. Lengths 253, 254 and 255 stand for nan, +inf and -inf
+// and are not followed by any text.
+func (d *redisDecoder) skipTextDouble() error {
+	n, err := d.r.ReadByte()
+	if err != nil || n >= 253 {
+		return err
+	}
+	return d.skip(int(n))
+}
+
+// skipModuleValue consumes the typed fields of a module value up to their
+// end marker.
+func (d *redisDecoder) skipModuleValue() error {
+	for {
+		op, err := d.length()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbModuleOpEOF:
+			return nil
+		case rdbModuleOpSInt, rdbModuleOpUInt:
+			_, err = d.length()
+		case rdbModuleOpFloat:
+			err = d.skip(4)
+		case rdbModuleOpDouble:
+			err = d.skip(8)
+		case rdbModuleOpString:
+			_, err = d.string()
+		default:
+			return fmt.Errorf("%w: unknown module value opcode %d", ErrCorrupt, op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipStream consumes a stream: its entries, stored as listpacks keyed by
+// ID, its metadata and its consumer groups. Later forms add metadata to
+// the stream, groups and consumers.
+func (d *redisDecoder) skipStream(typ byte) error {
+	lengths := func(n int) error {
+		var err error
+		for i := 0; i < n && err == nil; i++ {
+			_, err = d.length()
+		}
+		return err
+	}
+
+	n, err := d.length()
+	for i := uint64(0); i < n && err == nil; i++ {
+		if _, err = d.string(); err == nil {
+			_, err = d.string()
+		}
+	}
+	// Length and last ID, then the first ID, the largest deleted ID and
+	// the number of entries ever added.
+	if err == nil {
+		err = lengths(3)
+	}
+	if err == nil && typ != rdbTypeStreamListpacks {
+		err = lengths(5)
+	}
+
+	var groups uint64
+	if err == nil {
+		groups, err = d.length()
+	}
+	for g := uint64(0); g < groups && err == nil; g++ {
+		// Name, last delivered ID and entries read.
+		if _, err = d.string(); err == nil {
+			err = lengths(2)
+		}
+		if err == nil && typ != rdbTypeStreamListpacks {
+			err = lengths(1)
+		}
+		// Pending entries: ID, delivery time and delivery count.
+		var pending uint64
+		if err == nil {
+			pending, err = d.length()
+		}
+		for i := uint64(0); i < pending && err == nil; i++ {
+			if err = d.skip(16 + 8); err == nil {
+				_, err = d.length()
+			}
+		}
+		// Consumers: name, seen and active times, and pending IDs.
+		var consumers uint64
+		if err == nil {
+			consumers, err = d.length()
+		}
+		for c := uint64(0); c < consumers && err == nil; c++ {
+			if _, err = d.string(); err == nil {
+				err = d.skip(8)
+			}
+			if err == nil && typ == rdbTypeStreamListpacks3 {
+				err = d.skip(8)
+			}
+			if err == nil {
+				pending, err = d.length()
+			}
+			for i := uint64(0); i < pending && err == nil; i++ {
+				err = d.skip(16)
+			}
+		}
+	}
+	return err
+}
+
+// lzfDecompress expands LZF data, the compression Redis applies to long
+// strings, into a buffer of the expected length.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	if outLen < 0 {
+		return nil, fmt.Errorf("negative LZF output length %d", outLen)
+	}
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, errors.New("invalid LZF literal")
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference of length+2 bytes.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errors.New("invalid LZF back reference")
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("invalid LZF back reference")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > outLen {
+			return nil, errors.New("invalid LZF back reference")
+		}
+		// The source may overlap the bytes being written.
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("LZF data expanded to %d bytes, expected %d", len(out), outLen)
+	}
+	return out, nil
+}
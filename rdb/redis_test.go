@@ -0,0 +1,358 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"zencache/lru"
+)
+
+func TestJonesCRC(t *testing.T) {
+	// The check value from Redis's crc64.c.
+	var crc jonesCRC
+	crc.Write([]byte("12345"))
+	for _, b := range []byte("6789") {
+		crc.WriteByte(b)
+	}
+	if crc.Sum64() != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected e9c6d914c4b8d9ca, got %016x", crc.Sum64())
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	// A literal "a" followed by a 9 byte back reference to it.
+	out, err := lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x00}, 10)
+	if err != nil || string(out) != strings.Repeat("a", 10) {
+		t.Errorf("Expected ten a's, got %q, %v", out, err)
+	}
+	// A literal "abc" and a 4 byte reference 3 bytes back.
+	out, err = lzfDecompress([]byte{0x02, 'a', 'b', 'c', 0x40, 0x02}, 7)
+	if err != nil || string(out) != "abcabca" {
+		t.Errorf("Expected abcabca, got %q, %v", out, err)
+	}
+
+	for name, in := range map[string][]byte{
+		"reference before start": {0x00, 'a', 0x20, 0x05},
+		"short literal":          {0x05, 'a'},
+		"missing offset":         {0x00, 'a', 0x20},
+	} {
+		if _, err := lzfDecompress(in, 10); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := lzfDecompress([]byte{0x00, 'a'}, 2); err == nil {
+		t.Error("Expected an error for a length mismatch")
+	}
+	if _, err := lzfDecompress([]byte{0x00, 'a'}, -1); err == nil {
+		t.Error("Expected an error for a negative length")
+	}
+}
+
+func TestReadHugeLZFString(t *testing.T) {
+	for name, ulen := range map[string]uint64{
+		"past the string limit": maxStringLen + 1,
+		"negative as an int":    1 << 63,
+	} {
+		f := &redisFile{}
+		f.WriteString("REDIS0011")
+		f.WriteByte(rdbTypeString)
+		f.str("lzf")
+		f.Write([]byte{0xc3, 5, rdbLen64Bit})
+		binary.Write(f, binary.BigEndian, ulen)
+		f.Write([]byte{0x00, 'a', 0xe0, 0x00, 0x00})
+		f.WriteByte(rdbOpEOF)
+
+		if _, err := ReadRedis(bytes.NewReader(f.checksum()), func(lru.Record) bool { return true }); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+	}
+}
+
+func TestRedisRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	r := NewRDB(path)
+	r.SetFormat(FormatRedis)
+
+	nowMs := time.Now().UnixMilli()
+	records := []lru.Record{
+		{Key: "plain", Value: "v"},
+		{Key: "volatile", Value: "v", ExpireAt: nowMs + 60000, AccessedAt: nowMs - 5000, Freq: 42},
+		{Key: "long", Value: strings.Repeat("x", 20000), AccessedAt: nowMs},
+		{Key: "", Value: ""},
+	}
+	err := r.SaveRecords(func(fn func(lru.Record) error) error {
+		for _, rec := range records {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, []byte("REDIS0009")) {
+		t.Errorf("Expected a Redis header, got %q", data[:9])
+	}
+
+	var loaded []lru.Record
+	res, err := NewRDB(path).LoadRecords(func(rec lru.Record) bool {
+		loaded = append(loaded, rec)
+		return true
+	})
+	if err != nil || res.Loaded != len(records) || res.Skipped != 0 {
+		t.Fatalf("Expected %d records, got %+v, %v", len(records), res, err)
+	}
+	for i, rec := range loaded {
+		want := records[i]
+		// Idle time is stored in whole seconds.
+		if d := rec.AccessedAt - want.AccessedAt; want.AccessedAt != 0 && (d < -1000 || d > 1000) {
+			t.Errorf("%q: expected access time near %d, got %d", want.Key, want.AccessedAt, rec.AccessedAt)
+		}
+		rec.AccessedAt = want.AccessedAt
+		if rec != want {
+			t.Errorf("Expected %+v, got %+v", want, rec)
+		}
+	}
+}
+
+// redisFile builds a Redis RDB file the way Redis lays one out.
+type redisFile struct {
+	bytes.Buffer
+}
+
+func (f *redisFile) str(s string) *redisFile {
+	f.WriteByte(byte(len(s)))
+	f.WriteString(s)
+	return f
+}
+
+func (f *redisFile) checksum() []byte {
+	var crc jonesCRC
+	crc.Write(f.Bytes())
+	return binary.LittleEndian.AppendUint64(bytes.Clone(f.Bytes()), crc.Sum64())
+}
+
+func TestReadRedisFile(t *testing.T) {
+	f := &redisFile{}
+	f.WriteString("REDIS0011")
+	f.WriteByte(rdbOpAux)
+	f.str("redis-ver").str("7.2.4")
+	f.WriteByte(rdbOpAux)
+	f.str("used-mem") // an int32 encoded value
+	f.Write([]byte{0xc2, 0x40, 0x42, 0x0f, 0x00})
+	f.WriteByte(rdbOpSelectDB)
+	f.WriteByte(0)
+	f.WriteByte(rdbOpResizeDB)
+	f.Write([]byte{7, 1})
+
+	// Integer encoded values.
+	f.WriteByte(rdbTypeString)
+	f.str("int8")
+	f.Write([]byte{0xc0, 0xfb})
+	f.WriteByte(rdbTypeString)
+	f.str("int16")
+	f.Write([]byte{0xc1, 0x39, 0x30})
+	f.WriteByte(rdbOpExpireMs)
+	binary.Write(f, binary.LittleEndian, int64(1<<50))
+	f.WriteByte(rdbTypeString)
+	f.str("int32")
+	f.Write([]byte{0xc2, 0x87, 0xd6, 0x12, 0x00})
+
+	// An LZF compressed value with an LRU idle time and a seconds expiry.
+	f.WriteByte(rdbOpExpireSec)
+	binary.Write(f, binary.LittleEndian, int32(2000000000))
+	f.WriteByte(rdbOpFreq)
+	f.WriteByte(9)
+	f.WriteByte(rdbTypeString)
+	f.str("lzf")
+	f.Write([]byte{0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00})
+
+	// Types ZenCache does not store.
+	f.WriteByte(rdbTypeList)
+	f.str("list")
+	f.WriteByte(2)
+	f.str("a").str("b")
+	f.WriteByte(rdbTypeHashListpack)
+	f.str("hash").str("opaque listpack")
+	f.WriteByte(rdbTypeZSet2)
+	f.str("zset")
+	f.WriteByte(1)
+	f.str("member")
+	f.Write(make([]byte, 8))
+
+	// Database 1 is not used.
+	f.WriteByte(rdbOpSelectDB)
+	f.WriteByte(1)
+	f.WriteByte(rdbTypeString)
+	f.str("other").str("db")
+	f.WriteByte(rdbOpEOF)
+	good := f.checksum()
+
+	var loaded []lru.Record
+	res, err := ReadRedis(bytes.NewReader(good), func(rec lru.Record) bool {
+		loaded = append(loaded, rec)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if res.Loaded != 4 || res.Skipped != 4 {
+		t.Errorf("Expected 4 loaded and 4 skipped, got %+v", res)
+	}
+	got := fmt.Sprint(loaded)
+	expected := fmt.Sprint([]lru.Record{
+		{Key: "int8", Value: "-5"},
+		{Key: "int16", Value: "12345"},
+		{Key: "int32", Value: "1234567", ExpireAt: 1 << 50},
+		{Key: "lzf", Value: "aaaaaaaaaa", ExpireAt: 2000000000000, AccessedAt: loaded[3].AccessedAt, Freq: 9},
+	})
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	if loaded[3].AccessedAt == 0 {
+		t.Error("Expected a key with an LFU counter to get an access time")
+	}
+
+	// Redis writes a zero checksum when rdbchecksum is off.
+	unchecked := append(bytes.Clone(good[:len(good)-8]), make([]byte, 8)...)
+	if _, err := ReadRedis(bytes.NewReader(unchecked), func(lru.Record) bool { return true }); err != nil {
+		t.Errorf("Expected a zero checksum to be accepted, got %v", err)
+	}
+
+	cases := map[string][]byte{
+		"bad checksum": append(bytes.Clone(good[:len(good)-1]), good[len(good)-1]+1),
+		"truncated":    good[:len(good)-20],
+		"bad length": func() []byte {
+			b := bytes.Clone(good)
+			b[bytes.Index(b, []byte("int8"))-1] = 0x90
+			return b
+		}(),
+	}
+	for name, data := range cases {
+		if _, err := ReadRedis(bytes.NewReader(data), func(lru.Record) bool { return true }); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+	}
+
+	unsupported := append([]byte("REDIS0099"), good[9:]...)
+	if _, err := ReadRedis(bytes.NewReader(unsupported), nil); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Expected unsupported version error, got %v", err)
+	}
+}
+
+func TestReadRedisServerDumps(t *testing.T) {
+	cases := []struct {
+		file            string
+		loaded, skipped int
+	}{
+		{"keys_with_mixed_expiry.rdb", 4, 0},
+		{"multiple_databases.rdb", 1, 1},
+		{"rdb_version_5_with_checksum.rdb", 6, 0},
+		{"rdb_v7_list_quicklist.rdb", 0, 1},
+		{"regular_sorted_set.rdb", 0, 1},
+		{"sorted_set_as_ziplist.rdb", 0, 1},
+	}
+	for _, tc := range cases {
+		data, err := os.ReadFile(filepath.Join("testdata", tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadRedis(bytes.NewReader(data), func(lru.Record) bool { return true })
+		if err != nil || res.Loaded != tc.loaded || res.Skipped != tc.skipped {
+			t.Errorf("%s: expected %d loaded and %d skipped, got %+v, %v", tc.file, tc.loaded, tc.skipped, res, err)
+		}
+	}
+}
+
+func TestSkipRedisTypes(t *testing.T) {
+	f := &redisFile{}
+	f.WriteString("REDIS0012")
+	f.WriteByte(rdbOpSelectDB)
+	f.WriteByte(0)
+
+	// Sorted set scores stored as text, including +inf.
+	f.WriteByte(rdbTypeZSet)
+	f.str("zset")
+	f.WriteByte(2)
+	f.str("a").str("1.5")
+	f.str("b")
+	f.WriteByte(254)
+
+	// A stream with one listpack, a consumer group with a pending entry and
+	// a consumer.
+	f.WriteByte(rdbTypeStreamListpacks3)
+	f.str("stream")
+	f.WriteByte(1)
+	f.str(string(make([]byte, 16))).str("opaque listpack")
+	f.Write([]byte{1, 5, 0})       // length, last ID
+	f.Write([]byte{5, 0, 0, 0, 1}) // first ID, max deleted ID, entries added
+	f.WriteByte(1)
+	f.str("group")
+	f.Write([]byte{5, 0, 1}) // last delivered ID, entries read
+	f.WriteByte(1)
+	f.Write(make([]byte, 16+8))
+	f.WriteByte(1) // delivery count
+	f.WriteByte(1)
+	f.str("consumer")
+	f.Write(make([]byte, 8+8))
+	f.WriteByte(1)
+	f.Write(make([]byte, 16))
+
+	// A module value with one field of every kind, and module aux data.
+	f.WriteByte(rdbTypeModule2)
+	f.str("module")
+	f.Write([]byte{0x7f, 0xff}) // 14 bit module ID
+	f.Write([]byte{rdbModuleOpSInt, 7, rdbModuleOpUInt, 8})
+	f.WriteByte(rdbModuleOpFloat)
+	f.Write(make([]byte, 4))
+	f.WriteByte(rdbModuleOpDouble)
+	f.Write(make([]byte, 8))
+	f.WriteByte(rdbModuleOpString)
+	f.str("field")
+	f.WriteByte(rdbModuleOpEOF)
+	f.WriteByte(rdbOpModuleAux)
+	f.Write([]byte{9, rdbModuleOpUInt, 2, rdbModuleOpEOF})
+
+	// Hashes with field expiry.
+	f.WriteByte(rdbTypeHashMetadata)
+	f.str("hash")
+	f.Write(make([]byte, 8))
+	f.WriteByte(1)
+	f.WriteByte(0)
+	f.str("field").str("value")
+	f.WriteByte(rdbTypeHashListpackEx)
+	f.str("hashlp")
+	f.Write(make([]byte, 8))
+	f.str("opaque listpack")
+
+	f.WriteByte(rdbTypeString)
+	f.str("after").str("v")
+	f.WriteByte(rdbOpEOF)
+
+	var loaded []lru.Record
+	res, err := ReadRedis(bytes.NewReader(f.checksum()), func(rec lru.Record) bool {
+		loaded = append(loaded, rec)
+		return true
+	})
+	if err != nil || res.Loaded != 1 || res.Skipped != 5 {
+		t.Fatalf("Expected 1 loaded and 5 skipped, got %+v, %v", res, err)
+	}
+	if loaded[0].Key != "after" || loaded[0].Value != "v" {
+		t.Errorf("Expected after=v, got %+v", loaded[0])
+	}
+
+	old := &redisFile{}
+	old.WriteString("REDIS0011")
+	old.WriteByte(rdbTypeModulePreGA)
+	old.str("module")
+	if _, err := ReadRedis(bytes.NewReader(old.checksum()), nil); err == nil || !strings.Contains(err.Error(), "module") {
+		t.Errorf("Expected an error naming module values, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package repl
+
+// Backlog keeps the most recent bytes of the replication stream in a ring
+// buffer, so a replica that reconnects can be sent just the part it missed.
+// Positions in the stream are replication offsets: the number of bytes
+// produced before them. Backlog is not safe for concurrent use.
+type Backlog struct {
+	buf  []byte
+	head int   // index in buf of the byte at offset end-len
+	len  int   // bytes held, at most len(buf)
+	end  int64 // replication offset just past the newest byte
+}
+
+// NewBacklog returns an empty backlog holding up to size bytes, whose
+// stream starts at offset.
+func NewBacklog(size int, offset int64) *Backlog {
+	return &Backlog{buf: make([]byte, size), end: offset}
+}
+
+// Write appends p to the stream, discarding the oldest bytes once the
+// backlog is full.
+func (b *Backlog) Write(p []byte) {
+	b.end += int64(len(p))
+	size := len(b.buf)
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		copy(b.buf, p[len(p)-size:])
+		b.head, b.len = 0, size
+		return
+	}
+	tail := (b.head + b.len) % size
+	n := copy(b.buf[tail:], p)
+	copy(b.buf, p[n:])
+	b.len += len(p)
+	if b.len > size {
+		b.head = (b.head + b.len - size) % size
+		b.len = size
+	}
+}
+
+// Offset returns the replication offset just past the newest byte.
+func (b *Backlog) Offset() int64 {
+	return b.end
+}
+
+// First returns the offset of the oldest byte held.
+func (b *Backlog) First() int64 {
+	return b.end - int64(b.len)
+}
+
+// Len returns the number of bytes held.
+func (b *Backlog) Len() int {
+	return b.len
+}
+
+// Size returns the capacity in bytes.
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// ReadFrom returns a copy of the stream from offset to the newest byte. It
+// reports false if offset is not held, either because it has been
+// discarded or because it lies in the future.
+func (b *Backlog) ReadFrom(offset int64) ([]byte, bool) {
+	if offset < b.First() || offset > b.end {
+		return nil, false
+	}
+	n := int(b.end - offset)
+	out := make([]byte, n)
+	start := (b.head + b.len - n) % max(len(b.buf), 1)
+	copied := copy(out, b.buf[start:min(start+n, len(b.buf))])
+	copy(out[copied:], b.buf)
+	return out, true
+}
+
+// Resize changes the capacity, keeping as much of the newest data as fits.
+func (b *Backlog) Resize(size int) {
+	data, _ := b.ReadFrom(b.First())
+	if len(data) > size {
+		data = data[len(data)-size:]
+	}
+	b.buf = make([]byte, size)
+	b.head, b.len = 0, copy(b.buf, data)
+}
+
+// Reset discards the held bytes and restarts the stream at offset.
+func (b *Backlog) Reset(offset int64) {
+	b.head, b.len, b.end = 0, 0, offset
+}
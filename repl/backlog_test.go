@@ -0,0 +1,50 @@
+package repl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBacklog(t *testing.T) {
+	b := NewBacklog(8, 100)
+	if data, ok := b.ReadFrom(100); !ok || len(data) != 0 {
+		t.Errorf("Expected an empty read at the end, got %q, %v", data, ok)
+	}
+
+	b.Write([]byte("abcde"))
+	b.Write([]byte("fghij")) // wraps, discarding "ab"
+	if b.Offset() != 110 || b.First() != 102 || b.Len() != 8 {
+		t.Fatalf("Expected offsets 102 to 110, got %d to %d with %d bytes", b.First(), b.Offset(), b.Len())
+	}
+	for offset, expected := range map[int64]string{102: "cdefghij", 105: "fghij", 109: "j", 110: ""} {
+		if data, ok := b.ReadFrom(offset); !ok || string(data) != expected {
+			t.Errorf("ReadFrom(%d): expected %q, got %q, %v", offset, expected, data, ok)
+		}
+	}
+	for _, offset := range []int64{101, 111} {
+		if _, ok := b.ReadFrom(offset); ok {
+			t.Errorf("ReadFrom(%d): expected the offset not to be held", offset)
+		}
+	}
+
+	// A write larger than the backlog keeps its tail.
+	b.Write([]byte(strings.Repeat("x", 10) + "12345678"))
+	if data, _ := b.ReadFrom(b.First()); string(data) != "12345678" || b.Offset() != 128 {
+		t.Errorf("Expected the newest 8 bytes at offset 128, got %q at %d", data, b.Offset())
+	}
+
+	b.Resize(4)
+	if data, _ := b.ReadFrom(b.First()); string(data) != "5678" || b.First() != 124 {
+		t.Errorf("Expected shrinking to keep the newest bytes, got %q from %d", data, b.First())
+	}
+	b.Resize(16)
+	b.Write([]byte("9"))
+	if data, _ := b.ReadFrom(124); string(data) != "56789" {
+		t.Errorf("Expected growing to keep the data, got %q", data)
+	}
+
+	b.Reset(500)
+	if _, ok := b.ReadFrom(124); ok || b.Offset() != 500 || b.Len() != 0 {
+		t.Errorf("Expected reset to discard the data and move to 500, got %d bytes at %d", b.Len(), b.Offset())
+	}
+}
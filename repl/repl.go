@@ -2,29 +2,144 @@ package repl
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"zencache/resp"
 )
 
+// DefaultBacklogSize is the default capacity of the replication backlog,
+// the same as Redis's repl-backlog-size.
+const DefaultBacklogSize = 1 << 20
+
+// DefaultOutputBufferLimit is the default limit on the stream queued for a
+// replica, the hard limit of Redis's client-output-buffer-limit for
+// replicas.
+const DefaultOutputBufferLimit = 256 << 20
+
+// handshakeTimeout bounds each step of a replica's handshake with its master.
+const handshakeTimeout = 5 * time.Second
+
+// The delay before a replica reconnects to its master doubles after every
+// failed attempt, between these bounds.
+const (
+	reconnectMinDelay = 100 * time.Millisecond
+	reconnectMaxDelay = 5 * time.Second
+)
+
+// noReplID stands for an unset secondary replication ID, as in Redis.
+const noReplID = "0000000000000000000000000000000000000000"
+
+// ackInterval is how often a replica reports its offset to its master.
+const ackInterval = time.Second
+
+// errLinkClosed reports that the master link was replaced or closed.
+var errLinkClosed = errors.New("replication link closed")
+
 // ReplicationManager handles master-replica communication.
+//
+// Every node has a replication ID and offset naming a position in a stream
+// of write commands. A master appends each write to the stream; a replica
+// applies the stream it receives and keeps the same ID and offset. Both
+// keep the recent stream in a backlog, so a replica that reconnects with
+// PSYNC receives only what it missed. A replica the backlog cannot serve is
+// first sent a snapshot of the dataset.
 type ReplicationManager struct {
-	mu         sync.RWMutex
-	role       string // "master" or "replica"
-	replicas   []net.Conn
+	mu     sync.RWMutex
+	role   string // "master" or "replica"
+	replID string
+	// The ID this node had before its last promotion and the offset just
+	// past the end of that history, so replicas of the old master can
+	// continue from it.
+	replID2       string
+	secondOffset  int64
+	backlog       *Backlog
+	replicas      []*replica
+	listeningPort int
+	acked         chan struct{} // closed and replaced whenever a replica acknowledges
+	outputLimit   int           // bytes queued for a replica before it is dropped, 0 for no limit
+
+	// The master this node replicates, if it is a replica.
+	masterHost string
+	masterPort int
 	masterConn net.Conn
+	applyCmd   func([]string)
+	load       func(io.Reader) error
+	stopLink   chan struct{} // closed to stop reconnecting
+
+	linkUp         bool         // the master's stream is being applied
+	syncInProgress bool         // a snapshot is being received
+	linkDownSince  time.Time    // when the link last went down
+	lastIO         atomic.Int64 // Unix nanoseconds of the last read from the master
+
+	syncFull       int // PSYNCs answered with a full resynchronization
+	syncPartialOK  int // PSYNCs answered from the backlog
+	syncPartialErr int // PSYNCs that asked to continue but could not
+}
+
+// ReplicaInfo describes a replica of this node, as reported by INFO.
+type ReplicaInfo struct {
+	Addr   string // IP address of the replica
+	Port   int
+	State  string // "wait_bgsave" while a snapshot is sent, then "online"
+	Offset int64  // the offset the replica last acknowledged
+	Lag    time.Duration
+}
+
+// Status is a snapshot of the replication state, as reported by INFO.
+type Status struct {
+	Role           string
+	ReplID         string
+	ReplID2        string
+	SecondOffset   int64 // -1 if ReplID2 is unset
+	Offset         int64 // replication offset of this node
+	Replicas       int
+	ReplicaInfo    []ReplicaInfo
+	MasterHost     string
+	MasterPort     int
+	LinkUp         bool
+	SyncInProgress bool
+	LastIO         time.Time // zero if nothing was read from the master yet
+	LinkDownSince  time.Time
+	BacklogSize    int
+	BacklogFirst   int64 // offset of the oldest byte in the backlog
+	BacklogLen     int
+	SyncFull       int
+	SyncPartialOK  int
+	SyncPartialErr int
 }
 
 // NewReplicationManager creates a new replication manager.
 func NewReplicationManager() *ReplicationManager {
 	return &ReplicationManager{
-		role:     "master",
-		replicas: make([]net.Conn, 0),
+		role:         "master",
+		replID:       newReplID(),
+		replID2:      noReplID,
+		secondOffset: -1,
+		backlog:      NewBacklog(DefaultBacklogSize, 0),
+		replicas:     make([]*replica, 0),
+		acked:        make(chan struct{}),
+		outputLimit:  DefaultOutputBufferLimit,
 	}
 }
 
+// newReplID returns a random 40 character replication ID.
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Role returns the current role.
 func (r *ReplicationManager) Role() string {
 	r.mu.RLock()
@@ -37,35 +152,257 @@ func (r *ReplicationManager) IsMaster() bool {
 	return r.Role() == "master"
 }
 
+// SetListeningPort sets the port this node serves clients on, which it
+// reports to its master.
+func (r *ReplicationManager) SetListeningPort(port int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeningPort = port
+}
+
+// SetBacklogSize changes the capacity of the backlog in bytes.
+func (r *ReplicationManager) SetBacklogSize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backlog.Resize(size)
+}
+
+// Status returns the current replication state.
+func (r *ReplicationManager) Status() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var lastIO time.Time
+	if ns := r.lastIO.Load(); ns != 0 {
+		lastIO = time.Unix(0, ns)
+	}
+	infos := make([]ReplicaInfo, len(r.replicas))
+	for i, rep := range r.replicas {
+		infos[i] = rep.info()
+	}
+	return Status{
+		Role:           r.role,
+		ReplID:         r.replID,
+		ReplID2:        r.replID2,
+		SecondOffset:   r.secondOffset,
+		Offset:         r.backlog.Offset(),
+		Replicas:       len(r.replicas),
+		ReplicaInfo:    infos,
+		MasterHost:     r.masterHost,
+		MasterPort:     r.masterPort,
+		LinkUp:         r.linkUp,
+		SyncInProgress: r.syncInProgress,
+		LastIO:         lastIO,
+		LinkDownSince:  r.linkDownSince,
+		BacklogSize:    r.backlog.Size(),
+		BacklogFirst:   r.backlog.First(),
+		BacklogLen:     r.backlog.Len(),
+		SyncFull:       r.syncFull,
+		SyncPartialOK:  r.syncPartialOK,
+		SyncPartialErr: r.syncPartialErr,
+	}
+}
+
+// SetOutputBufferLimit sets how many bytes of the stream may be queued for
+// a replica that is not keeping up before it is disconnected. 0 removes the
+// limit.
+func (r *ReplicationManager) SetOutputBufferLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputLimit = limit
+}
+
 // AddReplica adds a replica connection.
 func (r *ReplicationManager) AddReplica(conn net.Conn) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.replicas = append(r.replicas, conn)
+	rep := newReplica(conn, 0)
+	r.replicas = append(r.replicas, rep)
+	r.startWriter(rep)
 }
 
 // RemoveReplica removes a replica connection.
 func (r *ReplicationManager) RemoveReplica(conn net.Conn) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for i, c := range r.replicas {
-		if c == conn {
-			r.replicas = append(r.replicas[:i], r.replicas[i+1:]...)
+	for _, rep := range r.replicas {
+		if rep.conn == conn {
+			r.dropReplica(rep)
+			return
+		}
+	}
+}
+
+// PropagateCommand appends a command to the replication stream and queues
+// it for every replica.
+func (r *ReplicationManager) PropagateCommand(args []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payload := resp.EncodeCommand(args)
+	r.backlog.Write(payload)
+	// Dropping a replica changes r.replicas.
+	for _, rep := range slices.Clone(r.replicas) {
+		r.enqueue(rep, payload)
+	}
+}
+
+// Sync answers a PSYNC from the replica on conn, which serves clients on
+// port, and adds it as a replica. offset is the first byte of the stream
+// the replica still needs. If replID is this node's and the backlog still
+// holds offset, the reply is +CONTINUE followed by the missed part of the
+// stream. Otherwise it is +FULLRESYNC with the ID and offset the replica
+// continues from, followed by a snapshot written by snapshot and then every
+// write made since the FULLRESYNC.
+//
+// Sync returns once the replica is receiving the stream. An error means it
+// could not be served and conn should be closed.
+func (r *ReplicationManager) Sync(conn net.Conn, port int, replID string, offset int64, snapshot func(io.Writer) error) error {
+	r.mu.Lock()
+	if r.role != "master" {
+		r.mu.Unlock()
+		err := errors.New("a replica cannot serve other replicas")
+		conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+		return err
+	}
+
+	if missed, ok := r.backlog.ReadFrom(offset - 1); ok && r.canContinue(replID, offset) {
+		r.syncPartialOK++
+		rep := newReplica(conn, port)
+		rep.ackOffset = offset - 1
+		rep.out = append([]byte("+CONTINUE "+r.replID+"\r\n"), missed...)
+		r.replicas = append(r.replicas, rep)
+		r.startWriter(rep)
+		r.mu.Unlock()
+		return nil
+	}
+
+	if replID != "?" {
+		r.syncPartialErr++
+	}
+	r.syncFull++
+	// Writes from here on are queued until the snapshot is sent. The
+	// snapshot may already contain some of them; replaying those is
+	// harmless because propagated commands are idempotent.
+	rep := newReplica(conn, port)
+	rep.syncing = true
+	_, err := fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n", r.replID, r.backlog.Offset())
+	if err == nil {
+		r.replicas = append(r.replicas, rep)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.sendSnapshot(rep, snapshot)
+}
+
+// canContinue reports whether a replica that asked to continue replID's
+// history from offset shares this node's history: either it follows this
+// node's current ID, or it followed the master this node was promoted from
+// and has not gone past the point of the promotion.
+func (r *ReplicationManager) canContinue(replID string, offset int64) bool {
+	return replID == r.replID || (replID == r.replID2 && offset <= r.secondOffset)
+}
+
+// sendSnapshot streams a snapshot to a replica being fully resynchronized,
+// then starts its writer to send the writes queued meanwhile. It uses the
+// framing of Redis's diskless replication, "$EOF:<mark>", the data and then
+// the mark, so the size need not be known in advance.
+func (r *ReplicationManager) sendSnapshot(rep *replica, snapshot func(io.Writer) error) error {
+	mark := newReplID()
+	w := bufio.NewWriterSize(rep.conn, 64<<10)
+	fmt.Fprintf(w, "$EOF:%s\r\n", mark)
+	err := snapshot(w)
+	if err == nil {
+		w.WriteString(mark)
+		err = w.Flush()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && rep.dropped {
+		err = errReplicaDropped
+	}
+	if err != nil {
+		r.dropReplica(rep)
+		return err
+	}
+	rep.syncing = false
+	r.startWriter(rep)
+	return nil
+}
+
+// Offset returns the replication offset of this node.
+func (r *ReplicationManager) Offset() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.backlog.Offset()
+}
+
+// Ack records that the replica on conn has processed the stream up to
+// offset, as reported by REPLCONF ACK.
+func (r *ReplicationManager) Ack(conn net.Conn, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rep := range r.replicas {
+		if rep.conn == conn {
+			rep.ackOffset = max(rep.ackOffset, offset)
+			rep.ackTime = time.Now()
+			close(r.acked)
+			r.acked = make(chan struct{})
 			return
 		}
 	}
 }
 
-// PropagateCommand sends a command to all replicas.
-func (r *ReplicationManager) PropagateCommand(cmd string) {
+// RequestAcks asks every replica to acknowledge its offset right away
+// rather than at its next periodic acknowledgement.
+func (r *ReplicationManager) RequestAcks() {
+	r.PropagateCommand([]string{"REPLCONF", "GETACK", "*"})
+}
+
+// WaitForAcks waits until at least n replicas have acknowledged offset, or
+// until timeout has passed unless it is 0, and returns how many have.
+func (r *ReplicationManager) WaitForAcks(offset int64, n int, timeout time.Duration) int {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		r.mu.RLock()
+		count, acked := r.ackedCount(offset), r.acked
+		r.mu.RUnlock()
+		if count >= n {
+			return count
+		}
+		select {
+		case <-acked:
+		case <-deadline:
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.ackedCount(offset)
+		}
+	}
+}
+
+// Acked returns how many replicas have acknowledged offset.
+func (r *ReplicationManager) Acked(offset int64) int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.ackedCount(offset)
+}
 
-	for _, conn := range r.replicas {
-		go func(c net.Conn) {
-			c.Write([]byte(cmd + "\n"))
-		}(conn)
+// ackedCount is Acked for callers that hold r.mu.
+func (r *ReplicationManager) ackedCount(offset int64) int {
+	count := 0
+	for _, rep := range r.replicas {
+		if !rep.syncing && rep.ackOffset >= offset {
+			count++
+		}
 	}
+	return count
 }
 
 // ReplicaCount returns the number of connected replicas.
@@ -75,41 +412,302 @@ func (r *ReplicationManager) ReplicaCount() int {
 	return len(r.replicas)
 }
 
-// ConnectToMaster connects to a master server as a replica.
-func (r *ReplicationManager) ConnectToMaster(host string, port int, applyCmd func(string)) error {
+// ConnectToMaster makes this node a replica of host:port. applyCmd
+// executes the master's replication stream and load replaces the dataset
+// with a snapshot from the master when a full resynchronization is needed.
+// A previous master link is closed.
+//
+// The link is kept up in the background: whenever it fails, it is
+// reestablished after a delay that doubles from reconnectMinDelay up to
+// reconnectMaxDelay. Each attempt asks to continue from this node's own
+// replication ID and offset, so a link that drops briefly only transfers
+// the writes made while it was down.
+func (r *ReplicationManager) ConnectToMaster(host string, port int, applyCmd func([]string), load func(io.Reader) error) {
 	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeLink()
 	r.role = "replica"
-	r.mu.Unlock()
+	r.masterHost, r.masterPort = host, port
+	r.applyCmd, r.load = applyCmd, load
+	r.linkDownSince = time.Now()
+	r.lastIO.Store(0)
+	stop := make(chan struct{})
+	r.stopLink = stop
+	go r.maintainLink(net.JoinHostPort(host, strconv.Itoa(port)), stop)
+}
+
+// PromoteToMaster turns a replica into a master, as REPLICAOF NO ONE does.
+// The link to the old master is closed and the node starts a new history
+// under a fresh replication ID. The old ID is kept as the secondary ID, so
+// other replicas of the old master that have not gone past this node's
+// offset can follow it with a partial sync. A master is left unchanged.
+func (r *ReplicationManager) PromoteToMaster() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role == "master" {
+		return
+	}
+	r.closeLink()
+	r.role = "master"
+	r.masterHost, r.masterPort = "", 0
+	r.shiftReplID(newReplID())
+}
+
+// shiftReplID makes id the replication ID, keeping the current one as the
+// secondary ID valid up to the current offset. The caller must hold r.mu.
+func (r *ReplicationManager) shiftReplID(id string) {
+	r.replID2 = r.replID
+	r.secondOffset = r.backlog.Offset() + 1
+	r.replID = id
+}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// closeLink stops the supervisor of the master link and closes the link.
+// The caller must hold r.mu.
+func (r *ReplicationManager) closeLink() {
+	if r.stopLink != nil {
+		close(r.stopLink)
+		r.stopLink = nil
+	}
+	if r.masterConn != nil {
+		r.masterConn.Close()
+		r.masterConn = nil
+	}
+	r.linkUp, r.syncInProgress = false, false
+}
+
+// maintainLink connects to the master at addr and reconnects whenever the
+// link fails, until stop is closed.
+func (r *ReplicationManager) maintainLink(addr string, stop <-chan struct{}) {
+	delay := reconnectMinDelay
+	for {
+		synced, err := r.runLink(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if synced {
+			delay = reconnectMinDelay
+		}
+		log.Printf("Replication link to master %s failed: %v; retrying in %v", addr, err, delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// runLink makes one connection to the master and applies its replication
+// stream until the link fails. synced reports whether the master's
+// stream was reached.
+func (r *ReplicationManager) runLink(addr string, stop <-chan struct{}) (synced bool, err error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	r.mu.Lock()
+	select {
+	case <-stop:
+		r.mu.Unlock()
+		conn.Close()
+		return false, errLinkClosed
+	default:
+	}
+	// Registered before the handshake so that closeLink can interrupt it.
 	r.masterConn = conn
+	replID, offset, listeningPort := r.replID, r.backlog.Offset(), r.listeningPort
+	applyCmd, load := r.applyCmd, r.load
 	r.mu.Unlock()
 
-	// Send REPLCONF to identify as a replica
-	conn.Write([]byte("REPLCONF listening-port\n"))
+	defer func() {
+		r.mu.Lock()
+		if r.masterConn == conn {
+			r.masterConn = nil
+			r.linkUp, r.syncInProgress = false, false
+			r.linkDownSince = time.Now()
+		}
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := resp.NewReader(&linkConn{conn, &r.lastIO})
+	reply, err := handshake(conn, reader, listeningPort, replID, offset)
+	if err != nil {
+		return false, err
+	}
 
-	// Start goroutine to receive commands from master
-	go func() {
-		reader := bufio.NewReader(conn)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				return
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid FULLRESYNC reply from master: %s", reply)
+		}
+		if !r.setLinkState(conn, false, true) {
+			return false, errLinkClosed
+		}
+		if err := receiveSnapshot(reader, load); err != nil {
+			return false, fmt.Errorf("loading the snapshot from the master: %w", err)
+		}
+		// Only now does the dataset match the master's stream at this
+		// point, so a failed transfer leaves the old position in place.
+		r.mu.Lock()
+		r.replID = fields[1]
+		r.replID2, r.secondOffset = noReplID, -1
+		r.backlog.Reset(masterOffset)
+		r.mu.Unlock()
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		// A master promoted from a sibling replica continues our history
+		// under its new ID.
+		if len(fields) == 2 {
+			r.mu.Lock()
+			if fields[1] != r.replID {
+				r.shiftReplID(fields[1])
 			}
-			line = strings.TrimSpace(line)
-			if len(line) > 0 {
-				applyCmd(line)
+			r.mu.Unlock()
+		}
+	default:
+		return false, fmt.Errorf("unexpected PSYNC reply from master: %s", reply)
+	}
+	if !r.setLinkState(conn, true, false) {
+		return false, errLinkClosed
+	}
+
+	ackNow, done := make(chan struct{}, 1), make(chan struct{})
+	defer close(done)
+	go r.sendAcks(conn, ackNow, done)
+
+	for {
+		v, err := reader.ReadValue()
+		if err != nil {
+			return true, err
+		}
+		if v.Type != resp.Array || len(v.Array) == 0 {
+			continue
+		}
+		args := make([]string, len(v.Array))
+		for i, arg := range v.Array {
+			args[i] = arg.Str
+		}
+
+		r.mu.Lock()
+		if r.masterConn != conn {
+			r.mu.Unlock()
+			return true, errLinkClosed
+		}
+		r.backlog.Write(resp.EncodeCommand(args))
+		r.mu.Unlock()
+
+		if strings.EqualFold(args[0], "REPLCONF") {
+			if len(args) > 1 && strings.EqualFold(args[1], "GETACK") {
+				select {
+				case ackNow <- struct{}{}:
+				default:
+				}
 			}
+			continue
 		}
-	}()
+		applyCmd(args)
+	}
+}
 
-	return nil
+// sendAcks reports this replica's offset to its master on conn when it
+// starts, every ackInterval and whenever ackNow is signalled, until done is
+// closed.
+func (r *ReplicationManager) sendAcks(conn net.Conn, ackNow <-chan struct{}, done <-chan struct{}) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		offset := r.Offset()
+		if _, err := conn.Write(resp.EncodeCommand([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)})); err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-ackNow:
+		}
+	}
+}
+
+// setLinkState records the state of the link on conn, reporting false if
+// conn is no longer the master link.
+func (r *ReplicationManager) setLinkState(conn net.Conn, up, syncing bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.masterConn != conn {
+		return false
+	}
+	r.linkUp, r.syncInProgress = up, syncing
+	return true
+}
+
+// linkConn records when data last arrived from the master.
+type linkConn struct {
+	net.Conn
+	lastIO *atomic.Int64
+}
+
+func (c *linkConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastIO.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// handshake introduces this node to its master and sends PSYNC, returning
+// the master's reply to it.
+func handshake(conn net.Conn, reader *resp.Reader, listeningPort int, replID string, offset int64) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	steps := [][]string{
+		{"PING"},
+		{"REPLCONF", "listening-port", strconv.Itoa(listeningPort)},
+		{"REPLCONF", "capa", "psync2"},
+		{"PSYNC", replID, strconv.FormatInt(offset+1, 10)},
+	}
+	var reply resp.Value
+	for _, args := range steps {
+		if _, err := conn.Write(resp.EncodeCommand(args)); err != nil {
+			return "", err
+		}
+		var err error
+		if reply, err = reader.ReadValue(); err != nil {
+			return "", err
+		}
+		if reply.Type == resp.Error {
+			return "", fmt.Errorf("master replied to %s: %s", args[0], reply.Str)
+		}
+	}
+	return reply.Str, nil
+}
+
+// receiveSnapshot passes the snapshot that follows +FULLRESYNC to load.
+func receiveSnapshot(reader *resp.Reader, load func(io.Reader) error) error {
+	header, err := reader.ReadLine()
+	if err != nil {
+		return err
+	}
+	mark, ok := strings.CutPrefix(header, "$EOF:")
+	if !ok {
+		return fmt.Errorf("unexpected snapshot header %q", header)
+	}
+	payload := reader.UntilMark([]byte(mark))
+	if err := load(payload); err != nil {
+		return err
+	}
+	// Skip anything load left unread to stay in step with the stream.
+	_, err = io.Copy(io.Discard, payload)
+	return err
 }
 
 // Close closes all replica connections.
@@ -117,10 +715,8 @@ func (r *ReplicationManager) Close() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	for _, conn := range r.replicas {
-		conn.Close()
-	}
-	if r.masterConn != nil {
-		r.masterConn.Close()
+	for _, rep := range slices.Clone(r.replicas) {
+		r.dropReplica(rep)
 	}
+	r.closeLink()
 }
@@ -0,0 +1,128 @@
+package repl
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// errReplicaDropped reports that a replica was disconnected while its
+// snapshot was being sent.
+var errReplicaDropped = errors.New("replica disconnected")
+
+// replica is a connection to a replica of this node. Its part of the
+// stream is queued in out and written by a single writer goroutine, so it
+// arrives in order and a slow replica holds up nothing but its own queue.
+type replica struct {
+	conn    net.Conn
+	port    int           // the port the replica serves clients on
+	syncing bool          // a snapshot is being sent; the writer waits for it
+	out     []byte        // stream queued for the writer
+	writing int           // bytes the writer is sending
+	wake    chan struct{} // signals the writer that out grew or the replica was dropped
+	dropped bool
+
+	ackOffset int64 // the offset the replica last acknowledged
+	ackTime   time.Time
+}
+
+func newReplica(conn net.Conn, port int) *replica {
+	return &replica{
+		conn:    conn,
+		port:    port,
+		wake:    make(chan struct{}, 1),
+		ackTime: time.Now(),
+	}
+}
+
+func (rep *replica) signal() {
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue queues p for rep, dropping the replica instead if that would
+// take its output buffer past the limit. The caller must hold r.mu.
+func (r *ReplicationManager) enqueue(rep *replica, p []byte) {
+	if rep.dropped {
+		return
+	}
+	if r.outputLimit > 0 && len(rep.out)+rep.writing+len(p) > r.outputLimit {
+		log.Printf("Disconnecting replica %s: its output buffer reached the limit of %d bytes", rep.conn.RemoteAddr(), r.outputLimit)
+		r.dropReplica(rep)
+		return
+	}
+	rep.out = append(rep.out, p...)
+	rep.signal()
+}
+
+// dropReplica removes rep, closes its connection and stops its writer. The
+// caller must hold r.mu.
+func (r *ReplicationManager) dropReplica(rep *replica) {
+	if rep.dropped {
+		return
+	}
+	rep.dropped = true
+	for i, other := range r.replicas {
+		if other == rep {
+			r.replicas = append(r.replicas[:i], r.replicas[i+1:]...)
+			break
+		}
+	}
+	rep.conn.Close()
+	rep.out = nil
+	rep.signal()
+}
+
+// startWriter starts the goroutine that writes rep's queued stream. The
+// caller must hold r.mu.
+func (r *ReplicationManager) startWriter(rep *replica) {
+	go r.writeStream(rep)
+	rep.signal()
+}
+
+// writeStream writes everything queued for rep, in order, until the replica
+// is dropped or a write fails.
+func (r *ReplicationManager) writeStream(rep *replica) {
+	for range rep.wake {
+		r.mu.Lock()
+		if rep.dropped {
+			r.mu.Unlock()
+			return
+		}
+		chunk := rep.out
+		rep.out, rep.writing = nil, len(chunk)
+		r.mu.Unlock()
+		if len(chunk) == 0 {
+			continue
+		}
+
+		_, err := rep.conn.Write(chunk)
+		r.mu.Lock()
+		rep.writing = 0
+		if err != nil {
+			r.dropReplica(rep)
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (rep *replica) info() ReplicaInfo {
+	info := ReplicaInfo{
+		Port:   rep.port,
+		State:  "online",
+		Offset: rep.ackOffset,
+		Lag:    time.Since(rep.ackTime),
+	}
+	if rep.syncing {
+		info.State = "wait_bgsave"
+	}
+	if addr, ok := rep.conn.RemoteAddr().(*net.TCPAddr); ok {
+		info.Addr = addr.IP.String()
+	}
+	return info
+}
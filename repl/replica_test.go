@@ -0,0 +1,66 @@
+package repl
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"zencache/resp"
+)
+
+func TestReplicaStreamOrder(t *testing.T) {
+	r := NewReplicationManager()
+	client, conn := net.Pipe()
+	defer client.Close()
+	r.AddReplica(conn)
+
+	const n = 1000
+	go func() {
+		for i := 0; i < n; i++ {
+			r.PropagateCommand([]string{"SET", "k", strconv.Itoa(i)})
+		}
+	}()
+	reader := resp.NewReader(client)
+	for i := 0; i < n; i++ {
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to read command %d: %v", i, err)
+		}
+		if got := v.Array[2].Str; got != strconv.Itoa(i) {
+			t.Fatalf("Expected command %d, got %s", i, got)
+		}
+	}
+}
+
+func TestReplicaOutputBufferLimit(t *testing.T) {
+	r := NewReplicationManager()
+	r.SetOutputBufferLimit(1000)
+	client, conn := net.Pipe()
+	defer client.Close()
+	r.AddReplica(conn)
+
+	// Nothing is read, so the stream queues up until the limit is hit.
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		r.PropagateCommand([]string{"SET", "k", value})
+	}
+	if r.ReplicaCount() != 0 {
+		t.Fatal("Expected the replica to be dropped")
+	}
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	// Without a limit a slow replica only falls behind.
+	r.SetOutputBufferLimit(0)
+	client, conn = net.Pipe()
+	defer client.Close()
+	r.AddReplica(conn)
+	for i := 0; i < 20; i++ {
+		r.PropagateCommand([]string{"SET", "k", value})
+	}
+	if r.ReplicaCount() != 1 {
+		t.Error("Expected the replica to be kept")
+	}
+}
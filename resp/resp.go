@@ -0,0 +1,647 @@
+// Package resp implements the Redis serialization protocol used on the wire
+// between clients, the server and replicas. RESP2 is spoken by default; a
+// Writer switched to RESP3 additionally emits maps, sets, doubles, nulls,
+// booleans and push frames.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Type identifies a RESP value by its wire prefix.
+type Type byte
+
+const (
+	SimpleString Type = '+'
+	Error        Type = '-'
+	Integer      Type = ':'
+	BulkString   Type = '$'
+	Array        Type = '*'
+
+	// RESP3 types. When writing RESP2 they are downgraded to the closest
+	// RESP2 type.
+	Null    Type = '_'
+	Double  Type = ','
+	Boolean Type = '#'
+	Map     Type = '%'
+	Set     Type = '~'
+	Push    Type = '>'
+)
+
+const (
+	maxInlineSize    = 64 * 1024
+	maxBulkSize      = 512 * 1024 * 1024
+	maxMultiBulkSize = 1024 * 1024
+)
+
+// ErrProtocol is wrapped by every error caused by malformed input.
+var ErrProtocol = errors.New("Protocol error")
+
+func protocolError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
+
+// Value is a single RESP value. Null marks a null bulk string or null array.
+// Maps keep their keys and values interleaved in Array.
+type Value struct {
+	Type  Type
+	Str   string
+	Int   int64
+	Float float64
+	Bool  bool
+	Array []Value
+	Null  bool
+}
+
+// NewSimpleString returns a simple string value such as "OK".
+func NewSimpleString(s string) Value {
+	return Value{Type: SimpleString, Str: s}
+}
+
+// NewError returns an error value. By convention msg starts with an error code.
+func NewError(msg string) Value {
+	return Value{Type: Error, Str: msg}
+}
+
+// Errorf returns an error value built from a format string.
+func Errorf(format string, args ...interface{}) Value {
+	return NewError(fmt.Sprintf(format, args...))
+}
+
+// NewInteger returns an integer value.
+func NewInteger(n int64) Value {
+	return Value{Type: Integer, Int: n}
+}
+
+// NewBulk returns a binary-safe bulk string value.
+func NewBulk(s string) Value {
+	return Value{Type: BulkString, Str: s}
+}
+
+// NewArray returns an array of values.
+func NewArray(vals []Value) Value {
+	return Value{Type: Array, Array: vals}
+}
+
+// NewBulkArray returns an array of bulk strings.
+func NewBulkArray(strs []string) Value {
+	vals := make([]Value, len(strs))
+	for i, s := range strs {
+		vals[i] = NewBulk(s)
+	}
+	return NewArray(vals)
+}
+
+// NewDouble returns a floating point value.
+func NewDouble(f float64) Value {
+	return Value{Type: Double, Float: f}
+}
+
+// NewBoolean returns a boolean value.
+func NewBoolean(b bool) Value {
+	return Value{Type: Boolean, Bool: b}
+}
+
+// NewMap returns a map from interleaved key and value pairs.
+func NewMap(pairs []Value) Value {
+	return Value{Type: Map, Array: pairs}
+}
+
+// NewSet returns an unordered collection of values.
+func NewSet(vals []Value) Value {
+	return Value{Type: Set, Array: vals}
+}
+
+// NewPush returns an out-of-band push frame such as a pub/sub message.
+func NewPush(vals []Value) Value {
+	return Value{Type: Push, Array: vals}
+}
+
+// NewNull returns the RESP3 null.
+func NewNull() Value {
+	return Value{Type: Null, Null: true}
+}
+
+// NullBulk returns the null bulk string used for missing keys.
+func NullBulk() Value {
+	return Value{Type: BulkString, Null: true}
+}
+
+// NullArray returns the null array.
+func NullArray() Value {
+	return Value{Type: Array, Null: true}
+}
+
+// OK is the canonical "+OK" reply.
+var OK = NewSimpleString("OK")
+
+// EncodeCommand encodes args as an array of bulk strings, the form used for
+// requests and for the replication stream.
+func EncodeCommand(args []string) []byte {
+	buf := make([]byte, 0, 16*len(args)+16)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Reader parses RESP values and commands from a stream.
+type Reader struct {
+	rd *bufio.Reader
+	n  int64 // bytes consumed by parsed values
+}
+
+// NewReader creates a new Reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReader(r)}
+}
+
+// Count returns the number of bytes consumed by every command and value
+// parsed so far. After a successful read it is the offset of the next one.
+func (r *Reader) Count() int64 {
+	return r.n
+}
+
+// Buffered returns the number of bytes already read from the stream but not
+// yet parsed. A non-zero value means the client is pipelining.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadCommand reads the next command. Both the multi-bulk form sent by client
+// libraries and the inline, space separated form typed by humans are
+// accepted; inline reports which one arrived. An empty command yields a nil
+// slice and no error.
+func (r *Reader) ReadCommand() (args []string, inline bool, err error) {
+	b, err := r.rd.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	if b[0] != byte(Array) {
+		line, err := r.readLine(maxInlineSize)
+		if err != nil {
+			return nil, true, err
+		}
+		args, err = SplitArgs(string(line))
+		return args, true, err
+	}
+
+	line, err := r.readLine(maxInlineSize)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := parseLength(line[1:], maxMultiBulkSize, "multibulk")
+	if err != nil {
+		return nil, false, err
+	}
+	if n <= 0 {
+		return nil, false, nil
+	}
+	args = make([]string, n)
+	for i := range args {
+		line, err := r.readLine(maxInlineSize)
+		if err != nil {
+			return nil, false, midCommand(err)
+		}
+		if len(line) == 0 || line[0] != byte(BulkString) {
+			return nil, false, protocolError("expected '$', got '%s'", firstByte(line))
+		}
+		size, err := parseLength(line[1:], maxBulkSize, "bulk")
+		if err != nil {
+			return nil, false, err
+		}
+		if size < 0 {
+			return nil, false, protocolError("invalid bulk length")
+		}
+		if args[i], err = r.readBulk(size); err != nil {
+			return nil, false, midCommand(err)
+		}
+	}
+	return args, false, nil
+}
+
+// ReadValue reads the next value of any type. It is used by the replica
+// side of replication and by tests to parse server replies.
+func (r *Reader) ReadValue() (Value, error) {
+	line, err := r.readLine(maxBulkSize)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, protocolError("empty line")
+	}
+	typ, body := Type(line[0]), string(line[1:])
+
+	switch typ {
+	case SimpleString, Error:
+		return Value{Type: typ, Str: body}, nil
+	case Integer:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return Value{}, protocolError("invalid integer '%s'", body)
+		}
+		return NewInteger(n), nil
+	case BulkString:
+		size, err := parseLength(line[1:], maxBulkSize, "bulk")
+		if err != nil {
+			return Value{}, err
+		}
+		if size < 0 {
+			return NullBulk(), nil
+		}
+		s, err := r.readBulk(size)
+		return NewBulk(s), err
+	case Array, Set, Push, Map:
+		n, err := parseLength(line[1:], maxMultiBulkSize, "multibulk")
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			return NullArray(), nil
+		}
+		if typ == Map {
+			n *= 2
+		}
+		vals := make([]Value, n)
+		for i := range vals {
+			if vals[i], err = r.ReadValue(); err != nil {
+				return Value{}, midCommand(err)
+			}
+		}
+		return Value{Type: typ, Array: vals}, nil
+	case Null:
+		return NewNull(), nil
+	case Boolean:
+		if body != "t" && body != "f" {
+			return Value{}, protocolError("invalid boolean '%s'", body)
+		}
+		return NewBoolean(body == "t"), nil
+	case Double:
+		f, err := strconv.ParseFloat(body, 64)
+		if err != nil {
+			return Value{}, protocolError("invalid double '%s'", body)
+		}
+		return NewDouble(f), nil
+	default:
+		return Value{}, protocolError("unexpected type byte '%c'", line[0])
+	}
+}
+
+// ReadLine reads a raw line without parsing it, such as the header of a
+// snapshot sent during replication.
+func (r *Reader) ReadLine() (string, error) {
+	line, err := r.readLine(maxInlineSize)
+	return string(line), err
+}
+
+// UntilMark returns a reader of the raw bytes that follow, up to and
+// excluding mark, which is consumed. Nothing past the mark is read, so
+// parsing can continue afterwards. It carries the diskless snapshot
+// transfer of replication, which ends with a random mark instead of
+// announcing its length.
+func (r *Reader) UntilMark(mark []byte) io.Reader {
+	return &markReader{r: r, mark: mark}
+}
+
+type markReader struct {
+	r    *Reader
+	mark []byte
+	hold []byte // trailing bytes that may begin the mark
+	out  []byte // bytes known to precede the mark
+	done bool
+}
+
+func (m *markReader) Read(p []byte) (int, error) {
+	for len(m.out) == 0 {
+		if m.done {
+			return 0, io.EOF
+		}
+		if _, err := m.r.rd.Peek(1); err != nil {
+			return 0, midCommand(err)
+		}
+		chunk, _ := m.r.rd.Peek(m.r.rd.Buffered())
+		data := append(append([]byte(nil), m.hold...), chunk...)
+		if i := bytes.Index(data, m.mark); i >= 0 {
+			consumed := i + len(m.mark) - len(m.hold)
+			m.r.rd.Discard(consumed)
+			m.r.n += int64(consumed)
+			m.out, m.hold, m.done = data[:i], nil, true
+			continue
+		}
+		keep := min(len(m.mark)-1, len(data))
+		m.r.rd.Discard(len(chunk))
+		m.r.n += int64(len(chunk))
+		m.out, m.hold = data[:len(data)-keep], data[len(data)-keep:]
+	}
+	n := copy(p, m.out)
+	m.out = m.out[n:]
+	return n, nil
+}
+
+// readLine returns the next CRLF (or LF) terminated line without its
+// terminator. Lines longer than limit are rejected.
+func (r *Reader) readLine(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		if err == nil {
+			if line == nil {
+				line = chunk
+			} else {
+				line = append(line, chunk...)
+			}
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && (len(line) > 0 || len(chunk) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, protocolError("too big inline request")
+		}
+	}
+	if len(line) > limit {
+		return nil, protocolError("too big inline request")
+	}
+	r.n += int64(len(line))
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+func (r *Reader) readBulk(size int) (string, error) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return "", protocolError("bulk string not terminated by CRLF")
+	}
+	r.n += int64(size + 2)
+	return string(buf[:size]), nil
+}
+
+// midCommand reports a clean EOF inside a command or aggregate as a
+// truncated stream.
+func midCommand(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
+
+func parseLength(b []byte, limit int, what string) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n > limit {
+		return 0, protocolError("invalid %s length", what)
+	}
+	return n, nil
+}
+
+// SplitArgs splits an inline command into arguments. Arguments are separated
+// by whitespace and may be wrapped in double quotes (with \n, \r, \t, \b, \a,
+// \\, \" and \xhh escapes) or single quotes (with \' escape).
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var cur []byte
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i >= len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					v, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					cur = append(cur, byte(v))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						cur = append(cur, '\n')
+					case 'r':
+						cur = append(cur, '\r')
+					case 't':
+						cur = append(cur, '\t')
+					case 'b':
+						cur = append(cur, '\b')
+					case 'a':
+						cur = append(cur, '\a')
+					default:
+						cur = append(cur, line[i])
+					}
+				case line[i] == '"':
+					// The closing quote must be followed by a space or nothing.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					cur = append(cur, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					cur = append(cur, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					cur = append(cur, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\t', '\n', '\r', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					cur = append(cur, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(cur))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == 0
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// Writer encodes RESP values onto a buffered stream.
+type Writer struct {
+	wr    *bufio.Writer
+	buf   []byte
+	proto int
+}
+
+// NewWriter creates a new Writer speaking RESP2.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(w), proto: 2}
+}
+
+// SetProtocol selects RESP2 or RESP3 for subsequent writes.
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Protocol returns the protocol version in use.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+// WriteValue encodes v. Call Flush to send buffered data.
+func (w *Writer) WriteValue(v Value) error {
+	w.buf = appendValue(w.buf[:0], v, w.proto)
+	_, err := w.wr.Write(w.buf)
+	return err
+}
+
+// WriteRaw writes s verbatim, bypassing RESP encoding.
+func (w *Writer) WriteRaw(s string) error {
+	_, err := w.wr.WriteString(s)
+	return err
+}
+
+// Flush writes any buffered data to the underlying stream.
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func appendValue(buf []byte, v Value, proto int) []byte {
+	if v.Null && proto >= 3 {
+		return append(buf, "_\r\n"...)
+	}
+
+	switch v.Type {
+	case SimpleString, Error:
+		buf = append(buf, byte(v.Type))
+		buf = append(buf, v.Str...)
+		return append(buf, '\r', '\n')
+	case Integer:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, v.Int, 10)
+		return append(buf, '\r', '\n')
+	case BulkString:
+		if v.Null {
+			return append(buf, "$-1\r\n"...)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(v.Str)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, v.Str...)
+		return append(buf, '\r', '\n')
+	case Array, Set, Push, Map:
+		if v.Null {
+			return append(buf, "*-1\r\n"...)
+		}
+		typ, n := v.Type, len(v.Array)
+		if proto < 3 {
+			typ = Array
+		} else if typ == Map {
+			n /= 2
+		}
+		buf = append(buf, byte(typ))
+		buf = strconv.AppendInt(buf, int64(n), 10)
+		buf = append(buf, '\r', '\n')
+		for _, elem := range v.Array {
+			buf = appendValue(buf, elem, proto)
+		}
+		return buf
+	case Null:
+		return append(buf, "$-1\r\n"...)
+	case Boolean:
+		if proto < 3 {
+			return appendValue(buf, NewInteger(boolInt(v.Bool)), proto)
+		}
+		if v.Bool {
+			return append(buf, "#t\r\n"...)
+		}
+		return append(buf, "#f\r\n"...)
+	case Double:
+		f := FormatDouble(v.Float)
+		if proto < 3 {
+			return appendValue(buf, NewBulk(f), proto)
+		}
+		buf = append(buf, ',')
+		buf = append(buf, f...)
+		return append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// FormatDouble formats f the way doubles appear on the wire.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
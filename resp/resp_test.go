@@ -0,0 +1,213 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadMultiBulkCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n"))
+
+	args, inline, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if inline {
+		t.Error("Expected multi-bulk command, got inline")
+	}
+	expected := []string{"SET", "key", "hello\r\nworld"}
+	if len(args) != len(expected) {
+		t.Fatalf("Expected %d args, got %d", len(expected), len(args))
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Errorf("Expected arg %d to be %q, got %q", i, expected[i], args[i])
+		}
+	}
+}
+
+func TestReadInlineCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("SET user:1001 \"John Doe\"\nGET 'it\\'s'\r\n"))
+
+	args, inline, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !inline {
+		t.Error("Expected inline command")
+	}
+	if len(args) != 3 || args[2] != "John Doe" {
+		t.Errorf("Expected quoted value to be one argument, got %q", args)
+	}
+
+	args, _, err = r.ReadCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(args) != 2 || args[1] != "it's" {
+		t.Errorf("Expected single quoted escape, got %q", args)
+	}
+}
+
+func TestSplitArgsEscapes(t *testing.T) {
+	args, err := SplitArgs(`SET k "a\nb\x41"`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if args[2] != "a\nbA" {
+		t.Errorf("Expected escapes to be decoded, got %q", args[2])
+	}
+
+	if _, err := SplitArgs(`SET k "unterminated`); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected protocol error for unbalanced quotes, got %v", err)
+	}
+}
+
+func TestReadCommandProtocolError(t *testing.T) {
+	r := NewReader(strings.NewReader("*1\r\n+SET\r\n"))
+
+	if _, _, err := r.ReadCommand(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+}
+
+func TestWriteValues(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	w.WriteValue(OK)
+	w.WriteValue(NewError("ERR boom"))
+	w.WriteValue(NewInteger(42))
+	w.WriteValue(NewBulk("bin\x00ary"))
+	w.WriteValue(NullBulk())
+	w.WriteValue(NewArray([]Value{NewBulk("a"), NewInteger(1)}))
+	w.Flush()
+
+	expected := "+OK\r\n-ERR boom\r\n:42\r\n$7\r\nbin\x00ary\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	original := NewArray([]Value{NewBulk("x"), NullBulk(), NewInteger(-7), NewSimpleString("PONG")})
+	w.WriteValue(original)
+	w.Flush()
+
+	v, err := NewReader(&buf).ReadValue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v.Type != Array || len(v.Array) != 4 {
+		t.Fatalf("Expected 4 element array, got %+v", v)
+	}
+	if v.Array[0].Str != "x" || !v.Array[1].Null || v.Array[2].Int != -7 || v.Array[3].Str != "PONG" {
+		t.Errorf("Round trip mismatch: %+v", v)
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	got := string(EncodeCommand([]string{"DEL", "k"}))
+	if got != "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n" {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
+
+func TestWriteRESP3Values(t *testing.T) {
+	values := []Value{
+		NewMap([]Value{NewBulk("proto"), NewInteger(3)}),
+		NewSet([]Value{NewBulk("a")}),
+		NewDouble(1.5),
+		NewBoolean(true),
+		NewNull(),
+		NullBulk(),
+		NewPush([]Value{NewBulk("message"), NewBulk("ch"), NewBulk("hi")}),
+	}
+
+	var resp3 bytes.Buffer
+	w := NewWriter(&resp3)
+	w.SetProtocol(3)
+	for _, v := range values {
+		w.WriteValue(v)
+	}
+	w.Flush()
+
+	expected := "%1\r\n$5\r\nproto\r\n:3\r\n~1\r\n$1\r\na\r\n,1.5\r\n#t\r\n_\r\n_\r\n" +
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"
+	if resp3.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, resp3.String())
+	}
+
+	var resp2 bytes.Buffer
+	w = NewWriter(&resp2)
+	for _, v := range values {
+		w.WriteValue(v)
+	}
+	w.Flush()
+
+	expected = "*2\r\n$5\r\nproto\r\n:3\r\n*1\r\n$1\r\na\r\n$3\r\n1.5\r\n:1\r\n$-1\r\n$-1\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"
+	if resp2.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, resp2.String())
+	}
+}
+
+func TestReadRESP3Values(t *testing.T) {
+	r := NewReader(strings.NewReader("%1\r\n$1\r\nk\r\n,2.5\r\n>1\r\n#f\r\n_\r\n"))
+
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v.Type != Map || len(v.Array) != 2 || v.Array[1].Float != 2.5 {
+		t.Errorf("Expected map with double value, got %+v", v)
+	}
+
+	v, err = r.ReadValue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v.Type != Push || len(v.Array) != 1 || v.Array[0].Type != Boolean || v.Array[0].Bool {
+		t.Errorf("Expected push with false boolean, got %+v", v)
+	}
+
+	if v, err = r.ReadValue(); err != nil || !v.Null {
+		t.Errorf("Expected null, got %+v (%v)", v, err)
+	}
+}
+
+func TestUntilMark(t *testing.T) {
+	mark := "0123456789abcdef"
+	payload := strings.Repeat("snapshot ", 1000) + "01234" // a partial mark inside
+	stream := "$EOF:" + mark + "\r\n" + payload + mark + "*1\r\n$4\r\nPING\r\n"
+
+	// Reading a byte at a time splits the mark across reads.
+	for _, src := range []io.Reader{strings.NewReader(stream), iotest.OneByteReader(strings.NewReader(stream))} {
+		r := NewReader(src)
+		if line, err := r.ReadLine(); err != nil || line != "$EOF:"+mark {
+			t.Fatalf("Expected the header line, got %q, %v", line, err)
+		}
+		data, err := io.ReadAll(r.UntilMark([]byte(mark)))
+		if err != nil || string(data) != payload {
+			t.Fatalf("Expected the %d byte payload, got %d bytes, %v", len(payload), len(data), err)
+		}
+		v, err := r.ReadValue()
+		if err != nil || len(v.Array) != 1 || v.Array[0].Str != "PING" {
+			t.Errorf("Expected PING after the mark, got %+v, %v", v, err)
+		}
+		if r.Count() != int64(len(stream)) {
+			t.Errorf("Expected %d bytes counted, got %d", len(stream), r.Count())
+		}
+	}
+
+	r := NewReader(strings.NewReader("no mark here"))
+	if _, err := io.ReadAll(r.UntilMark([]byte(mark))); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF without a mark, got %v", err)
+	}
+}
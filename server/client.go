@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"zencache/resp"
+)
+
+// client holds per-connection state.
+type client struct {
+	id     string
+	num    uint64
+	name   string
+	conn   net.Conn
+	reader *resp.Reader
+
+	mu     sync.Mutex // guards writer and inline; pub/sub goroutines write concurrently
+	writer *resp.Writer
+	inline bool // the last command arrived in the inline text form
+
+	subscriptions map[string]struct{}
+
+	// replaying is set on clients that re-execute writes already accepted
+	// elsewhere, which are applied even when the cache is over its limits.
+	replaying bool
+
+	isReplica     bool
+	listeningPort int // announced by a replica with REPLCONF listening-port
+	quit          bool
+}
+
+func newClient(conn net.Conn, num uint64) *client {
+	return &client{
+		id:     fmt.Sprintf("client-%d", num),
+		num:    num,
+		conn:   conn,
+		reader: resp.NewReader(conn),
+		writer: resp.NewWriter(conn),
+
+		subscriptions: make(map[string]struct{}),
+	}
+}
+
+// newFakeClient returns a client without a connection whose replies are
+// discarded. It executes commands replayed from the append-only file.
+func newFakeClient() *client {
+	return &client{
+		id:     "fake",
+		reader: resp.NewReader(strings.NewReader("")),
+		writer: resp.NewWriter(io.Discard),
+
+		subscriptions: make(map[string]struct{}),
+	}
+}
+
+// addSubscription records channel and reports whether it is new.
+func (c *client) addSubscription(channel string) bool {
+	if _, ok := c.subscriptions[channel]; ok {
+		return false
+	}
+	c.subscriptions[channel] = struct{}{}
+	return true
+}
+
+// removeSubscription forgets channel and returns the remaining count.
+func (c *client) removeSubscription(channel string) int {
+	delete(c.subscriptions, channel)
+	return len(c.subscriptions)
+}
+
+// subscribedChannels returns the client's channels in sorted order.
+func (c *client) subscribedChannels() []string {
+	channels := make([]string, 0, len(c.subscriptions))
+	for ch := range c.subscriptions {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// setInline records which form the current command arrived in so the reply
+// is rendered the same way.
+func (c *client) setInline(inline bool) {
+	c.mu.Lock()
+	c.inline = inline
+	c.mu.Unlock()
+}
+
+func (c *client) isInline() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inline
+}
+
+// setProtocol switches the connection between RESP2 and RESP3.
+func (c *client) setProtocol(proto int) {
+	c.mu.Lock()
+	c.writer.SetProtocol(proto)
+	c.mu.Unlock()
+}
+
+func (c *client) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writer.Protocol()
+}
+
+// inPubSubContext reports whether the client may only issue pub/sub
+// commands. A RESP2 client cannot tell messages from replies once it has
+// subscribed; RESP3 push frames and the inline text form have no such
+// ambiguity.
+func (c *client) inPubSubContext() bool {
+	return len(c.subscriptions) > 0 && !c.isInline() && c.protocol() < 3
+}
+
+// reply writes v to the client. Inline clients get the human readable text
+// form; everyone else gets RESP. Output is flushed unless more pipelined
+// commands are already waiting to be processed.
+func (c *client) reply(v resp.Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write(v)
+	if c.reader.Buffered() == 0 {
+		c.writer.Flush()
+	}
+}
+
+// push writes an out-of-band message such as a pub/sub delivery and flushes
+// it immediately.
+func (c *client) push(v resp.Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write(v)
+	c.writer.Flush()
+}
+
+func (c *client) write(v resp.Value) {
+	if c.inline {
+		c.writer.WriteRaw(formatText(v) + "\n")
+		return
+	}
+	c.writer.WriteValue(v)
+}
+
+// formatText renders a value in ZenCache's original text protocol, which
+// mirrors what redis-cli prints.
+func formatText(v resp.Value) string {
+	switch v.Type {
+	case resp.Error:
+		return "(error) " + v.Str
+	case resp.Integer:
+		return fmt.Sprintf("(integer) %d", v.Int)
+	case resp.BulkString, resp.Null:
+		if v.Null {
+			return "(nil)"
+		}
+		return v.Str
+	case resp.Double:
+		return "(double) " + resp.FormatDouble(v.Float)
+	case resp.Boolean:
+		if v.Bool {
+			return "(true)"
+		}
+		return "(false)"
+	case resp.Array, resp.Set, resp.Push, resp.Map:
+		if v.Null {
+			return "(nil)"
+		}
+		if len(v.Array) == 0 {
+			return "(empty array)"
+		}
+		lines := make([]string, len(v.Array))
+		for i, elem := range v.Array {
+			prefix := fmt.Sprintf("%d) ", i+1)
+			text := formatText(elem)
+			text = strings.ReplaceAll(text, "\n", "\n"+strings.Repeat(" ", len(prefix)))
+			lines[i] = prefix + text
+		}
+		return strings.Join(lines, "\n")
+	}
+	return v.Str
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"zencache/lru"
+)
+
+// commandFlags describe how a command may be used.
+type commandFlags uint8
+
+const (
+	// cmdWrite commands change the dataset. When they do, they are logged
+	// to the append-only file and sent to replicas, and a read-only replica
+	// accepts them only from its master.
+	cmdWrite commandFlags = 1 << iota
+	// cmdPubSub commands may still be issued by a RESP2 client that has
+	// active subscriptions.
+	cmdPubSub
+)
+
+// commandTable lists every command execute implements.
+var commandTable = map[string]commandFlags{
+	"SET":       cmdWrite,
+	"GET":       0,
+	"DEL":       cmdWrite,
+	"EXPIRE":    cmdWrite,
+	"PEXPIRE":   cmdWrite,
+	"EXPIREAT":  cmdWrite,
+	"PEXPIREAT": cmdWrite,
+	"TTL":       0,
+	"PTTL":      0,
+	"PERSIST":   cmdWrite,
+
+	"PING":        cmdPubSub,
+	"HELLO":       0,
+	"SUBSCRIBE":   cmdPubSub,
+	"UNSUBSCRIBE": cmdPubSub,
+	"PUBLISH":     0,
+	"QUIT":        cmdPubSub,
+
+	"BGREWRITEAOF": 0,
+	"SAVE":         0,
+	"BGSAVE":       0,
+	"DEBUG":        0,
+	"LASTSAVE":     0,
+	"REPLICAOF":    0,
+	"REPLCONF":     0,
+	"PSYNC":        0,
+	"WAIT":         0,
+	"CONFIG":       0,
+	"INFO":         0,
+	"SHUTDOWN":     0,
+}
+
+// inlineTrailing maps commands whose last argument, sent inline, takes the
+// rest of the line to their argument count, as in the original text
+// protocol: "PUBLISH news hello world" publishes "hello world".
+var inlineTrailing = map[string]int{
+	"PUBLISH": 3,
+}
+
+// joinTrailing joins the words past the last argument of an inline command
+// listed in inlineTrailing into that argument.
+func joinTrailing(args []string) []string {
+	n, ok := inlineTrailing[strings.ToUpper(args[0])]
+	if !ok || len(args) <= n {
+		return args
+	}
+	return append(args[:n-1:n-1], strings.Join(args[n-1:], " "))
+}
+
+// isWrite reports whether cmd, in upper case, changes the dataset.
+func isWrite(cmd string) bool {
+	return commandTable[cmd]&cmdWrite != 0
+}
+
+// ApplyCommand executes a write command from the master's replication
+// stream. Other commands are ignored.
+func (s *Server) ApplyCommand(args []string) {
+	if len(args) == 0 || !isWrite(strings.ToUpper(args[0])) {
+		return
+	}
+	// A new master link may start while the old one applies its last
+	// command, so the shared client is locked.
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	s.execute(s.master, args)
+}
+
+// logChange propagates a change the cache made, in a form that replays
+// identically: absolute rather than relative expiry times, with conditions
+// already decided. The cache calls it with the key's shard locked, so
+// changes to a key reach the append-only file and replicas in the order
+// they were made, while writes to other shards proceed.
+//
+// A master sends replicas an explicit DEL for each key it expires or
+// evicts, so they drop it at the same point in the stream instead of
+// relying on their own clocks and limits; replicas leave both to their
+// master.
+func (s *Server) logChange(ch lru.Change) {
+	switch ch.Op {
+	case lru.ChangeSet:
+		s.propagate(setCommand(ch.Key, ch.Value, ch.ExpireAt))
+	case lru.ChangeDel:
+		s.propagate([]string{"DEL", ch.Key})
+	case lru.ChangeExpire:
+		s.propagate([]string{"PEXPIREAT", ch.Key, strconv.FormatInt(ch.ExpireAt, 10)})
+	case lru.ChangePersist:
+		s.propagate([]string{"PERSIST", ch.Key})
+	case lru.ChangeExpired, lru.ChangeEvicted:
+		if s.repl.IsMaster() {
+			s.propagate([]string{"DEL", ch.Key})
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"zencache/aof"
+	"zencache/lru"
+	"zencache/rdb"
+	"zencache/repl"
+	"zencache/resp"
+)
+
+// Config holds the settings a server is started with.
+type Config struct {
+	Port            int
+	Capacity        int   // maximum number of items, 0 means unlimited
+	MaxMemory       int64 // maximum estimated bytes of data, 0 means unlimited
+	MaxMemoryPolicy lru.Policy
+	Shards          int    // independent cache segments, each with its own lock
+	Dir             string // directory of the snapshot and a relative AppendFilename
+	DBFilename      string
+	AppendOnly      bool
+	AppendFilename  string
+	AppendFsync     aof.FsyncPolicy
+
+	// The append-only file is rewritten automatically once it has grown by
+	// AutoAOFRewritePercentage percent since the last rewrite and is at
+	// least AutoAOFRewriteMinSize bytes. A percentage of 0 disables this.
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
+
+	// Save lists when to write background snapshots. Empty disables
+	// automatic snapshots, including the final one on shutdown.
+	Save []SaveRule
+	// RDBFormat is the file format snapshots are written in. Snapshots in
+	// either format are loaded.
+	RDBFormat rdb.Format
+	// SnapshotHistory is how many timestamped copies of past snapshots are
+	// kept next to the snapshot. 0 keeps none.
+	SnapshotHistory int
+	// RDBCompression is the flate level, 1 to 9, native snapshots are
+	// compressed with. 0 disables compression.
+	RDBCompression int
+	// ReplicaReadOnly makes a replica refuse writes from its clients, so
+	// that it cannot diverge from its master.
+	ReplicaReadOnly bool
+	// ReplBacklogSize is how many bytes of recent writes are kept for
+	// replicas that reconnect.
+	ReplBacklogSize int64
+	// ReplicaOutputBufferLimit is how many bytes of the replication stream
+	// may be queued for a replica before it is disconnected. 0 means no
+	// limit.
+	ReplicaOutputBufferLimit int64
+	// ImportRDB names a snapshot, native or from Redis, whose keys are
+	// loaded on startup on top of the persisted data.
+	ImportRDB string
+}
+
+// SaveRule triggers a background snapshot once at least Changes writes have
+// been made and Seconds have passed since the last successful save.
+type SaveRule struct {
+	Seconds int
+	Changes int
+}
+
+// DefaultSaveRules matches the Redis defaults: after an hour if anything
+// changed, after 5 minutes for 100 changes and after a minute for 10000.
+var DefaultSaveRules = []SaveRule{{3600, 1}, {300, 100}, {60, 10000}}
+
+// ParseSaveRules parses rules in the "seconds changes [seconds changes ...]"
+// form of the Redis save directive. An empty string yields no rules.
+func ParseSaveRules(s string) ([]SaveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters")
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters")
+		}
+		rules = append(rules, SaveRule{seconds, changes})
+	}
+	return rules, nil
+}
+
+// formatSaveRules renders rules in the form ParseSaveRules accepts.
+func formatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, 2*len(rules))
+	for _, r := range rules {
+		parts = append(parts, strconv.Itoa(r.Seconds), strconv.Itoa(r.Changes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// DefaultConfig returns the configuration used by NewServer.
+func DefaultConfig(port int) Config {
+	return Config{
+		Port:           port,
+		Capacity:       10000,
+		Shards:         16,
+		Dir:            ".",
+		DBFilename:     "zencache.rdb",
+		AppendFilename: "appendonly.aof",
+		AppendFsync:    aof.FsyncEverySec,
+
+		AutoAOFRewritePercentage: 100,
+		AutoAOFRewriteMinSize:    64 << 20,
+
+		Save: DefaultSaveRules,
+
+		ReplicaReadOnly: true,
+		ReplBacklogSize: repl.DefaultBacklogSize,
+
+		ReplicaOutputBufferLimit: repl.DefaultOutputBufferLimit,
+	}
+}
+
+// configParam is a setting exposed through CONFIG GET and CONFIG SET.
+type configParam struct {
+	name string
+	get  func(s *Server) string
+	set  func(s *Server, value string) error // nil if the setting is immutable
+}
+
+// configParams lists the settings in the order CONFIG GET returns them.
+var configParams = []configParam{
+	{
+		name: "port",
+		get:  func(s *Server) string { return strconv.Itoa(s.port) },
+	},
+	{
+		name: "shards",
+		get:  func(s *Server) string { return strconv.Itoa(s.cache.ShardCount()) },
+	},
+	{
+		name: "capacity",
+		get:  func(s *Server) string { return strconv.Itoa(s.cache.Capacity()) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			s.cache.SetCapacity(n)
+			return nil
+		},
+	},
+	{
+		name: "maxmemory",
+		get:  func(s *Server) string { return strconv.FormatInt(s.cache.MaxMemory(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.cache.SetMaxMemory(n)
+			return nil
+		},
+	},
+	{
+		name: "maxmemory-policy",
+		get:  func(s *Server) string { return s.cache.Policy().String() },
+		set: func(s *Server, value string) error {
+			p, err := lru.ParsePolicy(strings.ToLower(value))
+			if err != nil {
+				return err
+			}
+			s.cache.SetPolicy(p)
+			return nil
+		},
+	},
+	{
+		name: "dir",
+		get:  func(s *Server) string { return s.cfg.Dir },
+		set: func(s *Server, value string) error {
+			if info, err := os.Stat(value); err != nil {
+				return err
+			} else if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", value)
+			}
+			s.cfg.Dir = value
+			s.rdb.SetFilePath(s.snapshotPath())
+			return nil
+		},
+	},
+	{
+		name: "dbfilename",
+		get:  func(s *Server) string { return s.cfg.DBFilename },
+		set: func(s *Server, value string) error {
+			if value == "" || filepath.Base(value) != value {
+				return fmt.Errorf("dbfilename can't be a path, just a filename")
+			}
+			s.cfg.DBFilename = value
+			s.rdb.SetFilePath(s.snapshotPath())
+			return nil
+		},
+	},
+	{
+		name: "snapshot-history",
+		get:  func(s *Server) string { return strconv.Itoa(s.cfg.SnapshotHistory) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			s.cfg.SnapshotHistory = n
+			return nil
+		},
+	},
+	{
+		name: "appendonly",
+		get:  func(s *Server) string { return yesNo(s.aof != nil) },
+	},
+	{
+		name: "appendfilename",
+		get:  func(s *Server) string { return s.cfg.AppendFilename },
+	},
+	{
+		name: "appendfsync",
+		get: func(s *Server) string {
+			if s.aof != nil {
+				return s.aof.Policy().String()
+			}
+			return s.cfg.AppendFsync.String()
+		},
+		set: func(s *Server, value string) error {
+			p, err := aof.ParseFsyncPolicy(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.AppendFsync = p
+			if s.aof != nil {
+				s.aof.SetPolicy(p)
+			}
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-percentage",
+		get:  func(s *Server) string { return strconv.Itoa(s.cfg.AutoAOFRewritePercentage) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			s.cfg.AutoAOFRewritePercentage = n
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-min-size",
+		get:  func(s *Server) string { return strconv.FormatInt(s.cfg.AutoAOFRewriteMinSize, 10) },
+		set: func(s *Server, value string) error {
+			n, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.AutoAOFRewriteMinSize = n
+			return nil
+		},
+	},
+	{
+		name: "save",
+		get:  func(s *Server) string { return formatSaveRules(s.cfg.Save) },
+		set: func(s *Server, value string) error {
+			rules, err := ParseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.Save = rules
+			return nil
+		},
+	},
+	{
+		name: "rdb-format",
+		get:  func(s *Server) string { return s.rdb.Format().String() },
+		set: func(s *Server, value string) error {
+			f, err := rdb.ParseFormat(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.RDBFormat = f
+			s.rdb.SetFormat(f)
+			return nil
+		},
+	},
+	{
+		name: "rdb-compression-level",
+		get:  func(s *Server) string { return strconv.Itoa(s.rdb.Compression()) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("argument couldn't be parsed into an integer")
+			}
+			if err := s.rdb.SetCompression(n); err != nil {
+				return err
+			}
+			s.cfg.RDBCompression = n
+			return nil
+		},
+	},
+	{
+		name: "replica-read-only",
+		get:  func(s *Server) string { return yesNo(s.readOnly.Load()) },
+		set: func(s *Server, value string) error {
+			b, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.ReplicaReadOnly = b
+			s.readOnly.Store(b)
+			return nil
+		},
+	},
+	{
+		name: "repl-backlog-size",
+		get:  func(s *Server) string { return strconv.FormatInt(s.cfg.ReplBacklogSize, 10) },
+		set: func(s *Server, value string) error {
+			n, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 16<<10 {
+				return fmt.Errorf("repl-backlog-size must be at least 16kb")
+			}
+			s.cfg.ReplBacklogSize = n
+			s.repl.SetBacklogSize(int(n))
+			return nil
+		},
+	},
+	{
+		name: "replica-output-buffer-limit",
+		get:  func(s *Server) string { return strconv.FormatInt(s.cfg.ReplicaOutputBufferLimit, 10) },
+		set: func(s *Server, value string) error {
+			n, err := ParseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.cfg.ReplicaOutputBufferLimit = n
+			s.repl.SetOutputBufferLimit(int(n))
+			return nil
+		},
+	},
+}
+
+// snapshotPath returns where the snapshot lives. The caller must hold s.mu
+// or own the server exclusively.
+func (s *Server) snapshotPath() string {
+	return filepath.Join(s.cfg.Dir, s.cfg.DBFilename)
+}
+
+// appendOnlyPath returns the append-only file's path, resolving a relative
+// name against the data directory.
+func (s *Server) appendOnlyPath() string {
+	if filepath.IsAbs(s.cfg.AppendFilename) {
+		return s.cfg.AppendFilename
+	}
+	return filepath.Join(s.cfg.Dir, s.cfg.AppendFilename)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func lookupConfigParam(name string) (configParam, bool) {
+	for _, p := range configParams {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return configParam{}, false
+}
+
+// config implements CONFIG GET pattern [pattern ...] and
+// CONFIG SET parameter value [parameter value ...].
+func (s *Server) config(args []string) resp.Value {
+	if len(args) < 2 {
+		return wrongArgs("config")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		if len(args) < 3 {
+			return wrongArgs("config|get")
+		}
+		var pairs []resp.Value
+		for _, p := range configParams {
+			for _, pattern := range args[2:] {
+				if ok, _ := path.Match(strings.ToLower(pattern), p.name); ok {
+					pairs = append(pairs, resp.NewBulk(p.name), resp.NewBulk(p.get(s)))
+					break
+				}
+			}
+		}
+		return resp.NewMap(pairs)
+
+	case "SET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return wrongArgs("config|set")
+		}
+		// Validate every parameter before applying any of them.
+		params := make([]configParam, 0, len(args)/2-1)
+		for i := 2; i < len(args); i += 2 {
+			p, ok := lookupConfigParam(strings.ToLower(args[i]))
+			if !ok {
+				return resp.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+			}
+			if p.set == nil {
+				return resp.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", p.name)
+			}
+			params = append(params, p)
+		}
+		for i, p := range params {
+			if err := p.set(s, args[2+2*i+1]); err != nil {
+				return resp.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", p.name, err)
+			}
+		}
+		return resp.OK
+	}
+
+	return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+}
+
+// ParseMemory parses a byte count with an optional unit suffix as accepted
+// by Redis: b, k, kb, m, mb, g and gb (k means 1000, kb means 1024).
+func ParseMemory(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid memory value '%s'", s)
+	}
+	return n * mul, nil
+}
+
+// formatMemory renders a byte count the way INFO's *_human fields do.
+func formatMemory(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	// hz is how many times per second background tasks run.
+	hz = 10
+	// activeExpireBudget bounds the time spent reclaiming expired keys on
+	// each tick to a quarter of the tick interval.
+	activeExpireBudget = time.Second / hz / 4
+)
+
+// cron runs periodic background tasks until the server shuts down.
+func (s *Server) cron() {
+	ticker := time.NewTicker(time.Second / hz)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			// Replicas wait for their master's DEL instead.
+			if s.repl.IsMaster() {
+				s.cache.ActiveExpireCycle(activeExpireBudget)
+			}
+			s.cache.ReportExpired()
+			s.autoRewriteAOF()
+			s.autoSave()
+		}
+	}
+}
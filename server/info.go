@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// infoSections lists INFO sections in the order they are rendered.
+var infoSections = []string{"server", "memory", "persistence", "stats", "replication", "keyspace"}
+
+// info renders the INFO reply for the requested section, or every section
+// when section is empty, "all", "default" or "everything".
+func (s *Server) info(section string) string {
+	section = strings.ToLower(section)
+	var b strings.Builder
+
+	for _, name := range infoSections {
+		if section != "" && section != "all" && section != "default" && section != "everything" && section != name {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(name[:1])+name[1:])
+
+		switch name {
+		case "server":
+			fmt.Fprintf(&b, "zencache_version:%s\r\n", Version)
+			fmt.Fprintf(&b, "tcp_port:%d\r\n", s.port)
+			fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.startTime).Seconds()))
+			fmt.Fprintf(&b, "hz:%d\r\n", hz)
+
+		case "memory":
+			used, max := s.cache.UsedMemory(), s.cache.MaxMemory()
+			fmt.Fprintf(&b, "used_memory:%d\r\n", used)
+			fmt.Fprintf(&b, "used_memory_human:%s\r\n", formatMemory(used))
+			fmt.Fprintf(&b, "maxmemory:%d\r\n", max)
+			fmt.Fprintf(&b, "maxmemory_human:%s\r\n", formatMemory(max))
+			fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", s.cache.Policy())
+
+		case "persistence":
+			s.mu.Lock()
+			fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", s.dirty.Load())
+			fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", boolInt(s.saving))
+			fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", s.lastSave.Unix())
+			fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", status(s.lastSaveErr))
+			fmt.Fprintf(&b, "rdb_last_bgsave_time_sec:%d\r\n", int64(s.lastSaveTime.Seconds()))
+			fmt.Fprintf(&b, "rdb_saves:%d\r\n", s.saves)
+			s.mu.Unlock()
+			fmt.Fprintf(&b, "aof_enabled:%d\r\n", boolInt(s.aof != nil))
+			if s.aof != nil {
+				fmt.Fprintf(&b, "aof_current_size:%d\r\n", s.aof.Size())
+				fmt.Fprintf(&b, "aof_fsync:%s\r\n", s.aof.Policy())
+				fmt.Fprintf(&b, "aof_last_write_status:%s\r\n", status(s.aof.LastError()))
+				fmt.Fprintf(&b, "aof_base_size:%d\r\n", s.aof.BaseSize())
+				fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", boolInt(s.aof.Rewriting()))
+				fmt.Fprintf(&b, "aof_rewrites:%d\r\n", s.aof.Rewrites())
+				fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", status(s.aof.LastRewriteError()))
+			}
+
+		case "stats":
+			stats := s.cache.Stats()
+			fmt.Fprintf(&b, "evicted_keys:%d\r\n", stats.EvictedKeys)
+			fmt.Fprintf(&b, "keyspace_hits:%d\r\n", stats.Hits)
+			fmt.Fprintf(&b, "keyspace_misses:%d\r\n", stats.Misses)
+			fmt.Fprintf(&b, "keyspace_hit_ratio:%.4f\r\n", hitRatio(stats.Hits, stats.Misses))
+			fmt.Fprintf(&b, "tinylfu_admitted:%d\r\n", stats.Admitted)
+			fmt.Fprintf(&b, "tinylfu_rejected:%d\r\n", stats.Rejected)
+			fmt.Fprintf(&b, "expired_keys:%d\r\n", stats.ExpiredKeys)
+			fmt.Fprintf(&b, "expired_stale_perc:%.2f\r\n", stats.ExpiredStalePercent)
+			fmt.Fprintf(&b, "expired_time_cap_reached_count:%d\r\n", stats.ExpireTimeCapReached)
+			fmt.Fprintf(&b, "expire_cycles:%d\r\n", stats.ExpireCycles)
+			fmt.Fprintf(&b, "expire_cycle_cpu_milliseconds:%d\r\n", stats.ExpireCycleTime.Milliseconds())
+
+		case "replication":
+			st := s.repl.Status()
+			fmt.Fprintf(&b, "role:%s\r\n", st.Role)
+			if st.Role == "replica" {
+				fmt.Fprintf(&b, "master_host:%s\r\n", st.MasterHost)
+				fmt.Fprintf(&b, "master_port:%d\r\n", st.MasterPort)
+				if st.LinkUp {
+					b.WriteString("master_link_status:up\r\n")
+				} else {
+					b.WriteString("master_link_status:down\r\n")
+				}
+				fmt.Fprintf(&b, "master_last_io_seconds_ago:%d\r\n", secondsSince(st.LastIO))
+				fmt.Fprintf(&b, "master_sync_in_progress:%d\r\n", boolInt(st.SyncInProgress))
+				if !st.LinkUp {
+					fmt.Fprintf(&b, "master_link_down_since_seconds:%d\r\n", secondsSince(st.LinkDownSince))
+				}
+			}
+			fmt.Fprintf(&b, "replicas:%d\r\n", st.Replicas)
+			for i, rep := range st.ReplicaInfo {
+				fmt.Fprintf(&b, "replica%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n", i, rep.Addr, rep.Port, rep.State, rep.Offset, int64(rep.Lag.Seconds()))
+			}
+			fmt.Fprintf(&b, "master_replid:%s\r\n", st.ReplID)
+			fmt.Fprintf(&b, "master_replid2:%s\r\n", st.ReplID2)
+			fmt.Fprintf(&b, "master_repl_offset:%d\r\n", st.Offset)
+			fmt.Fprintf(&b, "second_repl_offset:%d\r\n", st.SecondOffset)
+			fmt.Fprintf(&b, "sync_full:%d\r\n", st.SyncFull)
+			fmt.Fprintf(&b, "sync_partial_ok:%d\r\n", st.SyncPartialOK)
+			fmt.Fprintf(&b, "sync_partial_err:%d\r\n", st.SyncPartialErr)
+			fmt.Fprintf(&b, "repl_backlog_active:1\r\n")
+			fmt.Fprintf(&b, "repl_backlog_size:%d\r\n", st.BacklogSize)
+			// Like Redis, the first byte is numbered from 1.
+			fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\n", st.BacklogFirst+1)
+			fmt.Fprintf(&b, "repl_backlog_histlen:%d\r\n", st.BacklogLen)
+
+		case "keyspace":
+			if keys := s.cache.Len(); keys > 0 {
+				fmt.Fprintf(&b, "db0:keys=%d,expires=%d\r\n", keys, s.cache.ExpiresLen())
+			}
+		}
+	}
+	return b.String()
+}
+
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// status renders the outcome of a persistence operation.
+func status(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+// secondsSince returns the whole seconds elapsed since t, or -1 if t is
+// zero.
+func secondsSince(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return int64(time.Since(t).Seconds())
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"zencache/lru"
+	"zencache/resp"
+)
+
+// setArgs is a parsed SET command.
+type setArgs struct {
+	key, value string
+	opts       lru.SetOptions
+	get        bool
+}
+
+// parseSet parses SET key value [NX|XX] [GET] [EX s|PX ms|EXAT ts|PXAT ms|KEEPTTL].
+func parseSet(args []string) (setArgs, resp.Value, bool) {
+	if len(args) < 3 {
+		return setArgs{}, wrongArgs("set"), false
+	}
+	sa := setArgs{key: args[1], value: args[2]}
+	hasExpire := false
+
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "NX":
+			if sa.opts.XX {
+				return sa, syntaxError, false
+			}
+			sa.opts.NX = true
+		case "XX":
+			if sa.opts.NX {
+				return sa, syntaxError, false
+			}
+			sa.opts.XX = true
+		case "GET":
+			sa.get = true
+		case "KEEPTTL":
+			if hasExpire {
+				return sa, syntaxError, false
+			}
+			sa.opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || sa.opts.KeepTTL || i+1 >= len(args) {
+				return sa, syntaxError, false
+			}
+			i++
+			// Unlike EXPIRE, SET rejects non-positive times outright.
+			if n, err := strconv.ParseInt(args[i], 10, 64); err != nil || n <= 0 {
+				return sa, resp.NewError("ERR invalid expire time in 'set' command"), false
+			}
+			at, ok := parseExpireTime(args[i], opt == "EX" || opt == "EXAT", opt == "EXAT" || opt == "PXAT")
+			if !ok {
+				return sa, resp.NewError("ERR invalid expire time in 'set' command"), false
+			}
+			sa.opts.ExpireAt = at
+			hasExpire = true
+		default:
+			return sa, syntaxError, false
+		}
+	}
+	return sa, resp.Value{}, true
+}
+
+// setCommand returns a SET that stores value under key with an absolute
+// expiry, so it replays the same regardless of when it is applied.
+func setCommand(key, value string, expireAt int64) []string {
+	args := []string{"SET", key, value}
+	if expireAt != 0 {
+		args = append(args, "PXAT", strconv.FormatInt(expireAt, 10))
+	}
+	return args
+}
+
+// set executes a parsed SET and returns its reply.
+func (s *Server) set(sa setArgs) resp.Value {
+	old, existed, written := s.cache.SetWithOptions(sa.key, sa.value, sa.opts)
+	switch {
+	case sa.get && existed:
+		return resp.NewBulk(old)
+	case sa.get, !written:
+		return resp.NullBulk()
+	}
+	return resp.OK
+}
+
+// parseExpireTime converts a user supplied expiry to Unix milliseconds.
+// seconds selects the unit and absolute whether the value is a timestamp
+// rather than an offset from now.
+func parseExpireTime(arg string, seconds, absolute bool) (int64, bool) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if seconds {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return 0, false
+		}
+		n *= 1000
+	}
+	if !absolute {
+		base := lru.Now()
+		if n > math.MaxInt64-base {
+			return 0, false
+		}
+		n += base
+	}
+	return n, true
+}
+
+// expire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with the
+// optional NX, XX, GT and LT conditions.
+func (s *Server) expire(args []string, seconds, absolute bool) resp.Value {
+	if len(args) < 3 || len(args) > 4 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	at, ok := parseExpireTime(args[2], seconds, absolute)
+	if !ok {
+		return resp.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(args[0]))
+	}
+
+	cond := lru.ExpireAlways
+	if len(args) == 4 {
+		switch strings.ToUpper(args[3]) {
+		case "NX":
+			cond = lru.ExpireNX
+		case "XX":
+			cond = lru.ExpireXX
+		case "GT":
+			cond = lru.ExpireGT
+		case "LT":
+			cond = lru.ExpireLT
+		default:
+			return resp.Errorf("ERR Unsupported option %s", args[3])
+		}
+	}
+
+	if !s.cache.Expire(args[1], at, cond) {
+		return resp.NewInteger(0)
+	}
+	return resp.NewInteger(1)
+}
+
+// ttl implements TTL and PTTL: -2 for a missing key, -1 for a key without
+// expiry, otherwise the remaining time.
+func (s *Server) ttl(args []string, seconds bool) resp.Value {
+	if len(args) != 2 {
+		return wrongArgs(strings.ToLower(args[0]))
+	}
+	at, exists := s.cache.ExpireTime(args[1])
+	switch {
+	case !exists:
+		return resp.NewInteger(-2)
+	case at == 0:
+		return resp.NewInteger(-1)
+	}
+
+	remaining := at - lru.Now()
+	if remaining < 0 {
+		remaining = 0
+	}
+	if seconds {
+		remaining = (remaining + 500) / 1000
+	}
+	return resp.NewInteger(remaining)
+}
+
+var syntaxError = resp.NewError("ERR syntax error")
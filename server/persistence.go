@@ -0,0 +1,394 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"zencache/aof"
+	"zencache/lru"
+	"zencache/rdb"
+	"zencache/resp"
+)
+
+var errSaveInProgress = errors.New("background save already in progress")
+
+// saveRetryDelay is how long automatic snapshots wait after a failure.
+const saveRetryDelay = 5 * time.Second
+
+// loadSnapshot loads the RDB snapshot if there is one, restoring expiry,
+// recency and LFU counters and skipping keys that expired while the server
+// was down. A damaged snapshot stops startup instead of silently starting
+// empty and later overwriting it.
+func (s *Server) loadSnapshot() error {
+	res, err := s.rdb.LoadRecords(s.cache.Restore)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", s.rdb.FilePath(), err)
+	}
+	s.cache.FinishRestore()
+	fmt.Printf("Loaded %d keys from RDB snapshot\n", res.Loaded)
+	printSkipped(res)
+	return nil
+}
+
+// importRDB loads the keys of the snapshot at path, native or written by
+// Redis, on top of the persisted data. They count as unsaved changes, and
+// the append-only file is rewritten so that it includes them.
+func (s *Server) importRDB(path string) error {
+	res, err := rdb.NewRDB(path).LoadRecords(s.cache.Restore)
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", path, err)
+	}
+	s.cache.FinishRestore()
+	s.dirty.Add(int64(res.Loaded))
+	fmt.Printf("Imported %d keys from %s\n", res.Loaded, path)
+	printSkipped(res)
+
+	if s.aof != nil {
+		return s.aof.Rewrite(s.dumpCommands)
+	}
+	return nil
+}
+
+func printSkipped(res rdb.LoadResult) {
+	if res.Skipped > 0 {
+		fmt.Printf("Skipped %d keys of unsupported types or outside database 0\n", res.Skipped)
+	}
+}
+
+// debug implements DEBUG RELOAD [MERGE] [NOFLUSH] [NOSAVE], which saves a
+// snapshot, empties the cache and loads the snapshot back. NOSAVE loads the
+// file as it is on disk; MERGE and NOFLUSH keep the current keys, replacing
+// those the snapshot also holds.
+//
+// Writes wait from the save until the new dataset is swapped in. The reload
+// is not propagated, so it is refused while the append-only file is on or
+// the node replicates, where it would make the dataset diverge from what
+// the file replays or the other nodes hold.
+func (s *Server) debug(args []string) resp.Value {
+	if len(args) < 2 {
+		return wrongArgs("debug")
+	}
+	if strings.ToUpper(args[1]) != "RELOAD" {
+		return resp.Errorf("ERR unknown subcommand '%s'", args[1])
+	}
+	save, flush := true, true
+	for _, opt := range args[2:] {
+		switch strings.ToUpper(opt) {
+		case "MERGE", "NOFLUSH":
+			flush = false
+		case "NOSAVE":
+			save = false
+		default:
+			return syntaxError
+		}
+	}
+
+	if s.aof != nil {
+		return resp.NewError("ERR DEBUG RELOAD is not allowed while the append only file is enabled")
+	}
+	if !s.repl.IsMaster() || s.repl.ReplicaCount() > 0 {
+		return resp.NewError("ERR DEBUG RELOAD is not allowed while replicating")
+	}
+
+	// The snapshot file is read with writes held off, so no save may be
+	// using it, even if the reload does not save.
+	if err := s.beginSave(); err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	var (
+		res     rdb.LoadResult
+		saveErr error
+	)
+	start, dirty := time.Now(), s.dirty.Load()
+	_, err := s.cache.Reload(func(walk func(func(lru.Record) error) error, restore func(lru.Record) bool) (err error) {
+		if save {
+			if saveErr = s.rdb.SaveRecords(walk); saveErr != nil {
+				return saveErr
+			}
+		}
+		if !flush {
+			walk(func(r lru.Record) error {
+				restore(r)
+				return nil
+			})
+		}
+		res, err = s.rdb.LoadRecords(restore)
+		return err
+	})
+	if save {
+		s.finishSave(start, dirty, saveErr)
+	} else {
+		s.endSave()
+	}
+	switch {
+	case saveErr != nil:
+		return resp.Errorf("ERR Error trying to save the DB: %v", saveErr)
+	case err != nil:
+		return resp.Errorf("ERR Error trying to load the RDB dump: %v", err)
+	}
+	fmt.Printf("DB reloaded by DEBUG RELOAD: %d keys\n", res.Loaded)
+	printSkipped(res)
+
+	if flush {
+		// The cache now matches the snapshot.
+		s.dirty.Store(0)
+	}
+	return resp.OK
+}
+
+// loadAppendOnlyFile replays the append-only file into the cache and opens
+// it for logging. It runs before the server accepts connections, and
+// before changes are propagated, so the replayed writes are not logged
+// again. They were accepted when they were made, and evictions were logged
+// as DELs, so they are replayed without enforcing the limits.
+func (s *Server) loadAppendOnlyFile() error {
+	c := newFakeClient()
+	c.replaying = true
+	s.cache.SetIgnoreLimits(true)
+	res, err := aof.Load(s.appendOnlyPath(), func(args []string) {
+		s.execute(c, args)
+	})
+	if err != nil {
+		return err
+	}
+	if res.Truncated > 0 {
+		fmt.Printf("Truncated %d bytes of an incomplete command at the end of the append only file\n", res.Truncated)
+	}
+	if res.Commands > 0 {
+		fmt.Printf("Loaded %d commands from the append only file\n", res.Commands)
+	}
+
+	s.aof, err = aof.Open(s.appendOnlyPath(), s.cfg.AppendFsync)
+	return err
+}
+
+// bgRewriteAOF implements BGREWRITEAOF.
+func (s *Server) bgRewriteAOF() resp.Value {
+	if s.aof == nil {
+		return resp.NewError("ERR Append only file is disabled")
+	}
+	if err := s.aof.BackgroundRewrite(s.dumpCommands); err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return resp.NewSimpleString("Background append only file rewriting started")
+}
+
+// autoRewriteAOF starts a rewrite once the append-only file has outgrown
+// the configured thresholds.
+func (s *Server) autoRewriteAOF() {
+	if s.aof == nil || s.aof.Rewriting() {
+		return
+	}
+	s.mu.Lock()
+	percentage, minSize := s.cfg.AutoAOFRewritePercentage, s.cfg.AutoAOFRewriteMinSize
+	s.mu.Unlock()
+
+	size, base := s.aof.Size(), s.aof.BaseSize()
+	if percentage == 0 || size < minSize {
+		return
+	}
+	if base > 0 && (size-base)*100/base < int64(percentage) {
+		return
+	}
+	fmt.Printf("Starting automatic rewriting of the append only file (%d bytes, base %d)\n", size, base)
+	s.aof.BackgroundRewrite(s.dumpCommands)
+}
+
+// dumpCommands emits one SET per live key that together rebuild the
+// dataset, oldest first so replaying them restores recency.
+func (s *Server) dumpCommands(emit func(args []string) error) error {
+	return s.cache.Walk(func(r lru.Record) error {
+		return emit(setCommand(r.Key, r.Value, r.ExpireAt))
+	})
+}
+
+// save implements SAVE, writing a snapshot before replying.
+func (s *Server) save() resp.Value {
+	if err := s.beginSave(); err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	if err := s.snapshot(); err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	return resp.OK
+}
+
+// bgsave implements BGSAVE, writing a snapshot in a new goroutine.
+// Clients keep running while it copies the cache one shard at a time.
+func (s *Server) bgsave() resp.Value {
+	if err := s.beginSave(); err != nil {
+		return resp.Errorf("ERR %v", err)
+	}
+	go func() {
+		if err := s.snapshot(); err != nil {
+			log.Printf("Background saving error: %v", err)
+		}
+	}()
+	return resp.NewSimpleString("Background saving started")
+}
+
+// beginSave marks a snapshot as running. Only one may run at a time.
+func (s *Server) beginSave() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.saving {
+		return errSaveInProgress
+	}
+	s.saving = true
+	return nil
+}
+
+// endSave releases the snapshot file claimed by beginSave without saving.
+func (s *Server) endSave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saving = false
+}
+
+// snapshot writes the cache to the RDB file and records the outcome.
+// The caller must have called beginSave.
+func (s *Server) snapshot() error {
+	start := time.Now()
+	dirty := s.dirty.Load()
+	err := s.rdb.SaveRecords(s.cache.Walk)
+	s.finishSave(start, dirty, err)
+	return err
+}
+
+// finishSave records the outcome of a save that started at start with
+// dirty unsaved changes. The caller must have called beginSave.
+func (s *Server) finishSave(start time.Time, dirty int64, err error) {
+	if err == nil {
+		s.rotateSnapshots()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saving = false
+	s.lastSaveTry = start
+	s.saves++
+	s.lastSaveErr = err
+	s.lastSaveTime = time.Since(start)
+	if err == nil {
+		s.lastSave = time.Now()
+		// Writes made during the save may be missing from it.
+		s.dirty.Add(-dirty)
+	}
+}
+
+// rotateSnapshots keeps a timestamped copy of a new snapshot when
+// snapshot-history is set. A failure is logged rather than failing the save.
+func (s *Server) rotateSnapshots() {
+	s.mu.Lock()
+	keep := s.cfg.SnapshotHistory
+	s.mu.Unlock()
+	if keep == 0 {
+		return
+	}
+	if err := s.rdb.Rotate(keep); err != nil {
+		log.Printf("Error keeping a copy of the snapshot: %v", err)
+	}
+}
+
+// saveRules returns a copy of the configured automatic snapshot rules.
+func (s *Server) saveRules() []SaveRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SaveRule(nil), s.cfg.Save...)
+}
+
+// autoSave starts a background snapshot when a save rule is satisfied.
+// After a failed save it waits saveRetryDelay before trying again.
+func (s *Server) autoSave() {
+	dirty := s.dirty.Load()
+	if dirty == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	var due SaveRule
+	found := false
+	for _, rule := range s.cfg.Save {
+		if dirty >= int64(rule.Changes) && time.Since(s.lastSave) >= time.Duration(rule.Seconds)*time.Second {
+			due, found = rule, true
+			break
+		}
+	}
+	retry := s.lastSaveErr == nil || time.Since(s.lastSaveTry) >= saveRetryDelay
+	s.mu.Unlock()
+
+	if !found || !retry {
+		return
+	}
+	fmt.Printf("%d changes in %d seconds. Saving...\n", due.Changes, due.Seconds)
+	s.bgsave()
+}
+
+// shutdownCommand implements SHUTDOWN [NOSAVE|SAVE]. It reports whether the
+// server stopped.
+func (s *Server) shutdownCommand(args []string) (resp.Value, bool) {
+	if len(args) > 2 {
+		return syntaxError, false
+	}
+	save := len(s.saveRules()) > 0
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "SAVE":
+			save = true
+		case "NOSAVE":
+			save = false
+		default:
+			return syntaxError, false
+		}
+	}
+	if err := s.shutdown(save); err != nil {
+		return resp.Errorf("ERR Errors trying to SHUTDOWN. %v", err), false
+	}
+	return resp.Value{}, true
+}
+
+// Shutdown stops the server gracefully. A final snapshot is written when
+// save rules are configured, replication links are closed and the
+// append-only file is synced and closed.
+// If the snapshot fails the server keeps running and the error is returned.
+func (s *Server) Shutdown() error {
+	return s.shutdown(len(s.saveRules()) > 0)
+}
+
+func (s *Server) shutdown(save bool) error {
+	if save {
+		// Wait for a running BGSAVE rather than failing on it.
+		for s.beginSave() != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Println("Saving the final RDB snapshot before exiting.")
+		if err := s.snapshot(); err != nil {
+			return err
+		}
+	}
+
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(s.done)
+	s.repl.Close()
+	if s.aof != nil {
+		if err := s.aof.Close(); err != nil {
+			log.Printf("Error closing the append only file: %v", err)
+		}
+	}
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"zencache/lru"
+	"zencache/rdb"
+	"zencache/resp"
+)
+
+// replicaSnapshot writes a native snapshot of the dataset for a replica
+// being fully resynchronized. It is streamed straight to the replica rather
+// than through the snapshot file, so it does not wait for a save in
+// progress or count as one.
+func (s *Server) replicaSnapshot(w io.Writer) error {
+	return rdb.WriteSnapshot(w, s.cache.Walk, s.rdb.Compression())
+}
+
+// loadReplicaSnapshot replaces the dataset with a snapshot received from
+// the master. The snapshot is written to a temporary file in the data
+// directory first, so its checksum is verified before any key is touched
+// and a transfer cut short leaves the old dataset in place. Clients see
+// the old dataset until the new one is complete.
+func (s *Server) loadReplicaSnapshot(r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.rdb.FilePath()), "temp-replica-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("receiving snapshot: %w", err)
+	}
+
+	var res rdb.LoadResult
+	flushed, err := s.cache.Replace(func(restore func(lru.Record) bool) (err error) {
+		res, err = rdb.NewRDB(tmp.Name()).LoadRecords(restore)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+	s.dirty.Add(int64(flushed + res.Loaded))
+	fmt.Printf("Loaded %d keys from the master's snapshot\n", res.Loaded)
+
+	if s.aof != nil {
+		// The append-only file must replay the new dataset, not the old one.
+		if err := s.aof.BackgroundRewrite(s.dumpCommands); err != nil {
+			log.Printf("Error rewriting the append only file after a full resync: %v", err)
+		}
+	}
+	return nil
+}
+
+// replconf implements REPLCONF. A replica sends listening-port and capa
+// during its handshake and ACK with its offset once it is receiving the
+// stream. ACK gets no reply, so reply is false for it.
+func (s *Server) replconf(c *client, args []string) (output resp.Value, reply bool) {
+	if len(args) < 2 || len(args)%2 == 0 {
+		return syntaxError, true
+	}
+	switch strings.ToLower(args[1]) {
+	case "ack":
+		if offset, err := strconv.ParseInt(args[2], 10, 64); err == nil && c.isReplica {
+			s.repl.Ack(c.conn, offset)
+		}
+		return resp.Value{}, false
+	case "listening-port":
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return resp.NewError("ERR value is not an integer or out of range"), true
+		}
+		c.listeningPort = port
+	}
+	return resp.OK, true
+}
+
+// wait implements WAIT numreplicas timeout, which blocks until at least
+// numreplicas replicas have acknowledged every write made so far, or until
+// timeout milliseconds have passed unless it is 0. It replies with the
+// number of replicas that acknowledged.
+func (s *Server) wait(args []string) resp.Value {
+	if len(args) != 3 {
+		return wrongArgs("wait")
+	}
+	n, err1 := strconv.Atoi(args[1])
+	timeout, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return resp.NewError("ERR timeout is negative")
+	}
+	if !s.repl.IsMaster() {
+		return resp.NewError("ERR WAIT cannot be used with replica instances")
+	}
+
+	offset := s.repl.Offset()
+	if acked := s.repl.Acked(offset); acked >= n {
+		return resp.NewInteger(int64(acked))
+	}
+	s.repl.RequestAcks()
+	return resp.NewInteger(int64(s.repl.WaitForAcks(offset, n, time.Duration(timeout)*time.Millisecond)))
+}
@@ -1,52 +1,126 @@
 package server
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+	"zencache/aof"
 	"zencache/lru"
 	"zencache/pubsub"
 	"zencache/rdb"
 	"zencache/repl"
+	"zencache/resp"
 )
 
+// Version is reported by HELLO and INFO.
+const Version = "1.0.0"
+
 type Server struct {
 	port     int
-	cache    *lru.Cache
+	cache    *lru.Sharded
 	pubsub   *pubsub.PubSub
 	rdb      *rdb.RDB
 	repl     *repl.ReplicationManager
+	aof      *aof.AOF // nil unless append-only persistence is enabled
 	clientID uint64
+	dirty    atomic.Int64 // writes since the last successful snapshot
+	readOnly atomic.Bool  // reject writes from clients while a replica
+
+	applyMu sync.Mutex // serializes commands from the master
+	master  *client    // executes the master's replication stream
+
+	listener net.Listener
+	closed   atomic.Bool
+	done     chan struct{} // closed on shutdown to stop background tasks
+
+	mu        sync.Mutex // guards cfg and the snapshot state below
+	cfg       Config
+	startTime time.Time
+
+	saving       bool // a SAVE, BGSAVE or DEBUG RELOAD is using the snapshot file
+	lastSave     time.Time
+	lastSaveTry  time.Time
+	lastSaveErr  error
+	lastSaveTime time.Duration
+	saves        int
 }
 
 func NewServer(port int) *Server {
-	return &Server{
-		port:   port,
-		cache:  lru.NewCache(10000),
-		pubsub: pubsub.NewPubSub(),
-		rdb:    rdb.NewRDB("zencache.rdb"),
-		repl:   repl.NewReplicationManager(),
-	}
+	return NewServerWithConfig(DefaultConfig(port))
 }
 
 func NewServerWithCapacity(port int, capacity int) *Server {
-	return &Server{
-		port:   port,
-		cache:  lru.NewCache(capacity),
+	cfg := DefaultConfig(port)
+	cfg.Capacity = capacity
+	return NewServerWithConfig(cfg)
+}
+
+func NewServerWithConfig(cfg Config) *Server {
+	cache := lru.NewSharded(cfg.Shards, cfg.Capacity)
+	cache.SetMaxMemory(cfg.MaxMemory)
+	cache.SetPolicy(cfg.MaxMemoryPolicy)
+
+	s := &Server{
+		cfg:    cfg,
+		port:   cfg.Port,
+		cache:  cache,
 		pubsub: pubsub.NewPubSub(),
-		rdb:    rdb.NewRDB("zencache.rdb"),
 		repl:   repl.NewReplicationManager(),
+		done:   make(chan struct{}),
+		master: newFakeClient(),
+
+		lastSave: time.Now(),
 	}
+	s.repl.SetListeningPort(cfg.Port)
+	s.repl.SetBacklogSize(int(cfg.ReplBacklogSize))
+	s.repl.SetOutputBufferLimit(int(cfg.ReplicaOutputBufferLimit))
+	s.rdb = rdb.NewRDB(s.snapshotPath())
+	s.rdb.SetFormat(cfg.RDBFormat)
+	s.readOnly.Store(cfg.ReplicaReadOnly)
+	// The master's writes were accepted under its own limits.
+	s.master.replaying = true
+	return s
 }
 
+// Start loads persisted data and serves clients until Shutdown, after which
+// it returns nil.
 func (s *Server) Start() error {
-	// Try to load from RDB on startup
-	if data, err := s.rdb.Load(); err == nil {
-		s.cache.LoadData(data)
-		fmt.Println("Loaded data from RDB snapshot")
+	s.startTime = time.Now()
+	if info, err := os.Stat(s.cfg.Dir); err != nil {
+		return fmt.Errorf("can't use data directory: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("can't use data directory: %s is not a directory", s.cfg.Dir)
+	}
+	if err := s.rdb.SetCompression(s.cfg.RDBCompression); err != nil {
+		return err
+	}
+
+	if s.cfg.AppendOnly {
+		// The append-only file is the more complete record, so it takes
+		// precedence over the snapshot.
+		if err := s.loadAppendOnlyFile(); err != nil {
+			return err
+		}
+	} else if err := s.loadSnapshot(); err != nil {
+		return err
+	}
+	// Loading rebuilt what is already on disk, so only changes from here
+	// on are counted, logged and sent to replicas. Evictions needed to get
+	// back within the limits are the first of them.
+	s.dirty.Store(0)
+	s.cache.SetChangeHook(s.logChange)
+	s.cache.SetIgnoreLimits(false)
+	if s.cfg.ImportRDB != "" {
+		if err := s.importRDB(s.cfg.ImportRDB); err != nil {
+			return err
+		}
 	}
 
 	addr := fmt.Sprintf(":%d", s.port)
@@ -56,186 +130,422 @@ func (s *Server) Start() error {
 	}
 	defer listener.Close()
 
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	go s.cron()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.closed.Load() {
+				return nil
+			}
 			fmt.Println("Error accepting connection:", err)
 			continue
 		}
 		clientID := atomic.AddUint64(&s.clientID, 1)
-		go s.handleConnection(conn, fmt.Sprintf("client-%d", clientID))
+		go s.handleConnection(conn, clientID)
 	}
 }
 
-// ApplyCommand applies a command directly (used for replication).
-func (s *Server) ApplyCommand(cmd string) {
-	parts := strings.Split(cmd, " ")
-	if len(parts) < 1 {
-		return
-	}
-	command := strings.ToUpper(parts[0])
+func (s *Server) handleConnection(conn net.Conn, clientID uint64) {
+	c := newClient(conn, clientID)
 
-	switch command {
-	case "SET":
-		if len(parts) >= 3 {
-			key := parts[1]
-			val := strings.Join(parts[2:], " ")
-			s.cache.Set(key, val)
+	defer conn.Close()
+	defer s.pubsub.UnsubscribeAll(c.id)
+
+	for !c.quit {
+		args, inline, err := c.reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) {
+				c.setInline(inline)
+				c.reply(resp.NewError("ERR " + err.Error()))
+			}
+			break
 		}
-	case "DEL":
-		if len(parts) >= 2 {
-			s.cache.Del(parts[1])
+		if len(args) == 0 {
+			continue
+		}
+		if inline {
+			args = joinTrailing(args)
+		}
+		c.setInline(inline)
+		if s.rejectsWrite(args[0]) {
+			c.reply(readOnlyError)
+			continue
 		}
+		s.execute(c, args)
 	}
-}
 
-func (s *Server) handleConnection(conn net.Conn, clientID string) {
-	defer conn.Close()
-	defer s.pubsub.UnsubscribeAll(clientID)
+	if c.isReplica {
+		s.repl.RemoveReplica(conn)
+	}
+}
 
-	reader := bufio.NewReader(conn)
-	isReplica := false
+// execute runs a single command and writes its reply to c.
+func (s *Server) execute(c *client, args []string) {
+	cmd := strings.ToUpper(args[0])
+	var output resp.Value
 
-	for {
-		message, err := reader.ReadString('\n')
-		if err != nil {
-			if isReplica {
-				s.repl.RemoveReplica(conn)
-			}
+	if c.inPubSubContext() && commandTable[cmd]&cmdPubSub == 0 {
+		c.reply(resp.Errorf("ERR Can't execute '%s': only SUBSCRIBE / UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd)))
+		return
+	}
+	// As in Redis, writes are refused while the append-only file cannot be
+	// written, since they could not be made durable. The master's stream
+	// is still applied.
+	if isWrite(cmd) && !c.replaying && s.aof != nil {
+		if err := s.aof.LastError(); err != nil {
+			c.reply(aofError(err))
 			return
 		}
+	}
 
-		message = strings.TrimSpace(message)
-		if len(message) == 0 {
-			continue
+	switch cmd {
+	case "SET":
+		sa, errReply, ok := parseSet(args)
+		if !ok {
+			output = errReply
+		} else if err := s.cache.FreeMemory(); err != nil && !c.replaying {
+			output = resp.NewError(err.Error())
+		} else {
+			output = s.set(sa)
 		}
 
-		parts := strings.Split(message, " ")
-		cmd := strings.ToUpper(parts[0])
-		var output string
-
-		switch cmd {
-		case "SET":
-			if len(parts) < 3 {
-				output = "(error) ERR wrong number of arguments for 'set' command\n"
+	case "GET":
+		if len(args) != 2 {
+			output = wrongArgs("get")
+		} else {
+			val, found := s.cache.Get(args[1])
+			if !found {
+				output = resp.NullBulk()
 			} else {
-				key := parts[1]
-				val := strings.Join(parts[2:], " ")
-				s.cache.Set(key, val)
-				output = "OK\n"
-				// Propagate to replicas
-				if s.repl.IsMaster() {
-					s.repl.PropagateCommand(message)
-				}
+				output = resp.NewBulk(val)
 			}
+		}
 
-		case "GET":
-			if len(parts) < 2 {
-				output = "(error) ERR wrong number of arguments for 'get' command\n"
-			} else {
-				val, found := s.cache.Get(parts[1])
-				if !found {
-					output = "(nil)\n"
-				} else {
-					output = fmt.Sprintf("%s\n", val)
+	case "DEL":
+		if len(args) < 2 {
+			output = wrongArgs("del")
+		} else {
+			deleted := 0
+			for _, key := range args[1:] {
+				if s.cache.Del(key) {
+					deleted++
 				}
 			}
+			output = resp.NewInteger(int64(deleted))
+		}
 
-		case "DEL":
-			if len(parts) < 2 {
-				output = "(error) ERR wrong number of arguments for 'del' command\n"
-			} else {
-				deleted := s.cache.Del(parts[1])
-				if deleted {
-					output = "(integer) 1\n"
-					// Propagate to replicas
-					if s.repl.IsMaster() {
-						s.repl.PropagateCommand(message)
-					}
-				} else {
-					output = "(integer) 0\n"
-				}
-			}
+	case "EXPIRE":
+		output = s.expire(args, true, false)
 
-		case "PING":
-			output = "PONG\n"
+	case "PEXPIRE":
+		output = s.expire(args, false, false)
 
-		case "SUBSCRIBE":
-			if len(parts) < 2 {
-				output = "(error) ERR wrong number of arguments for 'subscribe' command\n"
-			} else {
-				channel := parts[1]
-				sub := s.pubsub.Subscribe(channel, clientID)
-				output = fmt.Sprintf("SUBSCRIBED %s\n", channel)
-
-				go func(sub *pubsub.Subscriber, ch string) {
-					for msg := range sub.Messages {
-						conn.Write([]byte(fmt.Sprintf("MESSAGE %s %s\n", ch, msg)))
-					}
-				}(sub, channel)
-			}
+	case "EXPIREAT":
+		output = s.expire(args, true, true)
 
-		case "UNSUBSCRIBE":
-			if len(parts) < 2 {
-				output = "(error) ERR wrong number of arguments for 'unsubscribe' command\n"
-			} else {
-				channel := parts[1]
-				s.pubsub.Unsubscribe(channel, clientID)
-				output = fmt.Sprintf("UNSUBSCRIBED %s\n", channel)
+	case "PEXPIREAT":
+		output = s.expire(args, false, true)
+
+	case "TTL":
+		output = s.ttl(args, true)
+
+	case "PTTL":
+		output = s.ttl(args, false)
+
+	case "PERSIST":
+		if len(args) != 2 {
+			output = wrongArgs("persist")
+		} else if s.cache.Persist(args[1]) {
+			output = resp.NewInteger(1)
+		} else {
+			output = resp.NewInteger(0)
+		}
+
+	case "PING":
+		switch {
+		case len(args) > 2:
+			output = wrongArgs("ping")
+		case c.inPubSubContext():
+			msg := ""
+			if len(args) == 2 {
+				msg = args[1]
 			}
+			output = resp.NewBulkArray([]string{"pong", msg})
+		case len(args) == 2:
+			output = resp.NewBulk(args[1])
+		default:
+			output = resp.NewSimpleString("PONG")
+		}
 
-		case "PUBLISH":
-			if len(parts) < 3 {
-				output = "(error) ERR wrong number of arguments for 'publish' command\n"
-			} else {
-				channel := parts[1]
-				msg := strings.Join(parts[2:], " ")
-				count := s.pubsub.Publish(channel, msg)
-				output = fmt.Sprintf("(integer) %d\n", count)
+	case "HELLO":
+		output = s.hello(c, args[1:])
+
+	case "SUBSCRIBE":
+		if len(args) < 2 {
+			output = wrongArgs("subscribe")
+		} else {
+			for _, channel := range args[1:] {
+				c.reply(s.subscribe(c, channel))
 			}
+			return
+		}
+
+	case "UNSUBSCRIBE":
+		channels := args[1:]
+		if len(channels) == 0 {
+			channels = c.subscribedChannels()
+		}
+		if len(channels) == 0 {
+			output = subscriptionReply(c, "unsubscribe", "", 0)
+			break
+		}
+		for _, channel := range channels {
+			s.pubsub.Unsubscribe(channel, c.id)
+			c.reply(subscriptionReply(c, "unsubscribe", channel, c.removeSubscription(channel)))
+		}
+		return
+
+	case "PUBLISH":
+		if len(args) != 3 {
+			output = wrongArgs("publish")
+		} else {
+			count := s.pubsub.Publish(args[1], args[2])
+			output = resp.NewInteger(int64(count))
+		}
+
+	case "BGREWRITEAOF":
+		output = s.bgRewriteAOF()
 
-		case "SAVE":
-			err := s.rdb.Save(s.cache.GetAllData())
+	case "SAVE":
+		output = s.save()
+
+	case "BGSAVE":
+		output = s.bgsave()
+
+	case "DEBUG":
+		output = s.debug(args)
+
+	case "LASTSAVE":
+		s.mu.Lock()
+		output = resp.NewInteger(s.lastSave.Unix())
+		s.mu.Unlock()
+
+	case "REPLICAOF":
+		if len(args) != 3 {
+			output = wrongArgs("replicaof")
+		} else if strings.EqualFold(args[1], "no") && strings.EqualFold(args[2], "one") {
+			s.repl.PromoteToMaster()
+			s.cache.SetIgnoreLimits(false)
+			output = resp.OK
+		} else {
+			host := args[1]
+			port, err := strconv.Atoi(args[2])
 			if err != nil {
-				output = fmt.Sprintf("(error) %v\n", err)
+				output = resp.NewError("ERR invalid port")
 			} else {
-				output = "OK\n"
+				// The link is made in the background, as in Redis; INFO
+				// reports its state. The master's evictions arrive as
+				// DELs, so the replica makes none of its own.
+				s.cache.SetIgnoreLimits(true)
+				s.repl.ConnectToMaster(host, port, s.ApplyCommand, s.loadReplicaSnapshot)
+				output = resp.OK
 			}
+		}
+
+	case "REPLCONF":
+		var reply bool
+		if output, reply = s.replconf(c, args); !reply {
+			return
+		}
+
+	case "WAIT":
+		output = s.wait(args)
+
+	case "PSYNC":
+		if len(args) != 3 {
+			output = wrongArgs("psync")
+			break
+		}
+		offset, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			output = resp.NewError("ERR value is not an integer or out of range")
+			break
+		}
+		if err := s.repl.Sync(c.conn, c.listeningPort, args[1], offset, s.replicaSnapshot); err != nil {
+			// The replica may already be reading a snapshot, so no reply
+			// can be sent.
+			log.Printf("Error syncing replica %s: %v", c.conn.RemoteAddr(), err)
+			c.quit = true
+			return
+		}
+		// From here on the connection carries the replication stream.
+		c.isReplica = true
+		return
+
+	case "CONFIG":
+		output = s.config(args)
+
+	case "INFO":
+		if len(args) > 2 {
+			output = syntaxError
+		} else {
+			section := ""
+			if len(args) == 2 {
+				section = args[1]
+			}
+			output = resp.NewBulk(s.info(section))
+		}
+
+	case "SHUTDOWN":
+		var stopped bool
+		if output, stopped = s.shutdownCommand(args); stopped {
+			// Like Redis, a successful SHUTDOWN closes the connection
+			// without replying.
+			c.quit = true
+			return
+		}
+
+	case "QUIT":
+		c.quit = true
+		output = resp.OK
+
+	default:
+		output = resp.Errorf("ERR unknown command '%s'", args[0])
+	}
 
-		case "REPLICAOF":
-			if len(parts) < 3 {
-				output = "(error) ERR wrong number of arguments for 'replicaof' command\n"
+	if isWrite(cmd) && s.aof != nil {
+		// Under appendfsync always, the change is on disk before it is
+		// acknowledged, and one that could not be logged is not
+		// acknowledged at all.
+		if err := s.aof.Flush(); err != nil {
+			output = aofError(err)
+		}
+	}
+	c.reply(output)
+}
+
+// propagate records a write in the append-only file and, on a master,
+// sends it to replicas. It is called by logChange with the written key's
+// shard locked. A failed append is reported to the writer by execute.
+func (s *Server) propagate(args []string) {
+	s.dirty.Add(1)
+	if s.aof != nil {
+		if err := s.aof.Append(args); err != nil {
+			log.Printf("Error writing to the append only file: %v", err)
+		}
+	}
+	if s.repl.IsMaster() {
+		s.repl.PropagateCommand(args)
+	}
+}
+
+// subscribe registers c on channel and starts delivering its messages.
+func (s *Server) subscribe(c *client, channel string) resp.Value {
+	if !c.addSubscription(channel) {
+		return subscriptionReply(c, "subscribe", channel, len(c.subscriptions))
+	}
+	sub := s.pubsub.Subscribe(channel, c.id)
+
+	go func(sub *pubsub.Subscriber, ch string) {
+		for msg := range sub.Messages {
+			if c.isInline() {
+				c.push(resp.NewSimpleString(fmt.Sprintf("MESSAGE %s %s", ch, msg)))
 			} else {
-				host := parts[1]
-				port, err := strconv.Atoi(parts[2])
-				if err != nil {
-					output = "(error) ERR invalid port\n"
-				} else {
-					err = s.repl.ConnectToMaster(host, port, s.ApplyCommand)
-					if err != nil {
-						output = fmt.Sprintf("(error) %v\n", err)
-					} else {
-						output = "OK\n"
-					}
-				}
+				c.push(resp.NewPush([]resp.Value{resp.NewBulk("message"), resp.NewBulk(ch), resp.NewBulk(msg)}))
 			}
+		}
+	}(sub, channel)
 
-		case "REPLCONF":
-			// This is sent by replicas during handshake
-			isReplica = true
-			s.repl.AddReplica(conn)
-			output = "OK\n"
+	return subscriptionReply(c, "subscribe", channel, len(c.subscriptions))
+}
 
-		case "INFO":
-			output = fmt.Sprintf("role:%s\nreplicas:%d\n", s.repl.Role(), s.repl.ReplicaCount())
+// subscriptionReply builds the confirmation for SUBSCRIBE and UNSUBSCRIBE.
+// Inline clients keep the original "SUBSCRIBED channel" text. An empty
+// channel means the client had no subscriptions to remove.
+func subscriptionReply(c *client, kind, channel string, count int) resp.Value {
+	if c.isInline() {
+		return resp.NewSimpleString(strings.TrimSpace(strings.ToUpper(kind) + "D " + channel))
+	}
+	ch := resp.NewBulk(channel)
+	if channel == "" {
+		ch = resp.NullBulk()
+	}
+	return resp.NewPush([]resp.Value{
+		resp.NewBulk(kind),
+		ch,
+		resp.NewInteger(int64(count)),
+	})
+}
 
-		case "QUIT":
-			return
+// hello implements HELLO [protover [AUTH username password] [SETNAME name]].
+// ZenCache has no authentication, so credentials are accepted as the
+// password-less default user would accept them in Redis.
+func (s *Server) hello(c *client, args []string) resp.Value {
+	proto := c.protocol()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return resp.NewError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return resp.NewError("NOPROTO unsupported protocol version")
+		}
+		proto = v
+		args = args[1:]
+	}
 
+	name := c.name
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return resp.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return resp.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+			}
+			name = args[i+1]
+			i++
 		default:
-			output = fmt.Sprintf("(error) ERR unknown command '%s'\n", cmd)
+			return resp.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
 		}
-
-		conn.Write([]byte(output))
 	}
+
+	c.name = name
+	c.setProtocol(proto)
+
+	return resp.NewMap([]resp.Value{
+		resp.NewBulk("server"), resp.NewBulk("zencache"),
+		resp.NewBulk("version"), resp.NewBulk(Version),
+		resp.NewBulk("proto"), resp.NewInteger(int64(proto)),
+		resp.NewBulk("id"), resp.NewInteger(int64(c.num)),
+		resp.NewBulk("mode"), resp.NewBulk("standalone"),
+		resp.NewBulk("role"), resp.NewBulk(s.repl.Role()),
+		resp.NewBulk("modules"), resp.NewArray([]resp.Value{}),
+	})
+}
+
+var readOnlyError = resp.NewError("READONLY You can't write against a read only replica.")
+
+// aofError is the reply to a write that could not be logged to the
+// append-only file.
+func aofError(err error) resp.Value {
+	return resp.Errorf("MISCONF Errors writing to the AOF file: %v", err)
+}
+
+// rejectsWrite reports whether a client's command must be refused because
+// it is a write and this node is a read-only replica.
+func (s *Server) rejectsWrite(cmd string) bool {
+	return s.readOnly.Load() && isWrite(strings.ToUpper(cmd)) && !s.repl.IsMaster()
+}
+
+func wrongArgs(cmd string) resp.Value {
+	return resp.Errorf("ERR wrong number of arguments for '%s' command", cmd)
 }